@@ -1,16 +1,37 @@
 package mpawsdynamodb
 
 import (
+	"context"
+	"errors"
 	"flag"
+	"fmt"
+	"io"
 	"log"
+	"math"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"regexp"
+	"sort"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/client"
 	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/endpoints"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
 	mp "github.com/mackerelio/go-mackerel-plugin-helper"
 )
 
@@ -21,17 +42,62 @@ const (
 	metricsTypeMaximum     = "Maximum"
 	metricsTypeMinimum     = "Minimum"
 	metricsTypeSampleCount = "SampleCount"
+
+	// period of datapoints in seconds
+	metricsPeriod = 60
+
+	defaultPrefix = "dynamodb"
+	// inserted after the prefix for the account metrics with AccountSubPrefix
+	accountSubPrefix = "account"
+
+	// output formats
+	formatMackerel = "mackerel"
+	formatGraphite = "graphite"
+	formatJSONL    = "jsonl"
+
+	// detect the account ID with sts:GetCallerIdentity
+	accountIDAuto = "auto"
+
+	// datapoint selection strategies of -select
+	selectLatest = "latest"
+	selectMax    = "max"
+	selectAvg    = "avg"
+	selectFirst  = "first"
+
+	// item size covered by a read capacity unit, for a strongly consistent read
+	readCapacityUnitBytes = 4096
 )
 
-// has 1 CloudWatch MetricName and corresponding N Mackerel Metrics
-type metricsGroup struct {
+// Version is the version of the plugin, set at build time with
+// -ldflags "-X github.com/astj/mackerel-plugin-aws-dynamodb/lib.Version=<version>"
+var Version = "devel"
+
+// MetricsGroup has 1 CloudWatch MetricName and corresponding N Mackerel Metrics
+type MetricsGroup struct {
 	CloudWatchName string
-	Metrics        []metric
+	Metrics        []Metric
+	// period of datapoints in seconds, metricsPeriod if 0
+	Period int64
+	// timeout of each GetMetricStatistics call of the group, GroupTimeout of the plugin if 0
+	Timeout time.Duration
+	// query only the periods which have ended, rather than reporting the one in progress, e.g. for hourly sums
+	CompletePeriods bool
+}
+
+// period returns the period of the datapoints in seconds
+func (mg MetricsGroup) period() int64 {
+	if mg.Period == 0 {
+		return metricsPeriod
+	}
+	return mg.Period
 }
 
-type metric struct {
+// Metric is a Mackerel metric taken from a statistic (Type) of the CloudWatch metric
+type Metric struct {
 	MackerelName string
 	Type         string
+	// the metric may have no datapoint normally (e.g. errors and throttle events), which doesn't fail the Strict mode
+	Optional bool
 }
 
 // DynamoDBPlugin mackerel plugin for aws kinesis
@@ -42,20 +108,281 @@ type DynamoDBPlugin struct {
 	AccessKeyID     string
 	SecretAccessKey string
 	Region          string
-	CloudWatch      *cloudwatch.CloudWatch
+	RoleARN         string
+	Endpoint        string
+	SigningRegion   string
+	FIPS            bool
+	AWSConfigFile   string
+	AccountID       string
+	OwningAccount   string
+	RetryBaseDelay  time.Duration
+	RetryMaxDelay   time.Duration
+	SDKLogLevel     aws.LogLevelType
+	CloudWatch      cloudwatchiface.CloudWatchAPI
+	// used only for the table description (BillingMode)
+	DynamoDB dynamodbiface.DynamoDBAPI
+	// used only to resolve AccountID "auto"
+	STS stsiface.STSAPI
+
+	// give up the run after this many CloudWatch calls failed in a row by throttling, 5xx or network errors, or 0 to try every metric
+	MaxConsecutiveFailures int
+	// deadline of the whole FetchMetrics, after which the remaining metrics are skipped, or 0 for none
+	TotalTimeout time.Duration
+	// bounds each GetMetricStatistics call unless the group has its own Timeout, so a slow group doesn't use up TotalTimeout (0: none)
+	GroupTimeout time.Duration
+
+	// CloudWatch metric names of the table metrics to collect, or nil for all
+	MetricsFor map[string]bool
+	// operations to collect the per-operation metrics for, or nil for all
+	Operations map[string]bool
+	// extra dimensions of the table metrics, on top of TableName
+	Dimensions []*cloudwatch.Dimension
+
+	// how often the plugin is run, widening the queried time window for infrequent runs
+	CollectInterval time.Duration
+
+	// how to reduce the datapoints in the window to a value: latest (default), max, avg or first
+	Select string
+
+	SkipLatest   bool
+	MinAge       time.Duration
+	NaNMetrics   []string
+	Scale        float64
+	ScaleMetrics []string
+	// drop the consumed capacity sums, keeping only their normalized per-second values
+	NormalizedOnly bool
+	// report the latency in seconds instead of milliseconds
+	LatencySeconds bool
+	// also report the Average of the consumed capacity divided by the period
+	AveragePerSecond bool
+	// bytes read per read capacity unit relative to 4 KB, e.g. 2 for eventually consistent reads, or 0 not to estimate the read throughput
+	ReadConsistencyFactor float64
+
+	CloudWatchNames   bool
+	AssertProvisioned bool
+	// fail when a metric not marked Optional has no datapoint
+	Strict bool
+
+	Utilization        bool
+	AggregateAllTables bool
+	Stream             bool
+	Replication        bool
+	GlobalTable        bool
+	Trend              bool
+	AccountMetrics     bool
+	// puts the account metrics under accountSubPrefix, apart from the table metrics
+	AccountSubPrefix        bool
+	NoProvisionedGraphLines bool
+	Unstacked               bool
+	Quiet                   bool
+	EmitPeriod              bool
+	Verbose                 bool
+	BillingMode             bool
+	// look up the table differing only in case when CloudWatch has no metrics for TableName (see correctTableNameCase)
+	FixTableNameCase bool
+
+	// graph name to unit, overriding the default unit of the graph
+	Units map[string]string
+
+	// shift of the timestamps written by the graphite and jsonl formats, e.g. for a host with a skewed clock
+	TimestampOffset time.Duration
+	// significant digits which the graphite and jsonl formats round the float values to, all the digits if 0
+	Precision int
+
+	// file recording the values of the last run, to report only the metrics whose value has changed since, if set
+	LastValuesFile string
+
+	// groups added by WithMetricGroups
+	customMetricsGroups []MetricsGroup
+
+	// GraphDefinition is computed once per plugin
+	graphdefOnce sync.Once
+	graphdef     map[string]mp.Graphs
+
+	// DescribeTable result, cached across runs in the same process
+	tableDescription *dynamodb.TableDescription
+	// creates a CloudWatch client for another region, e.g. of a replica, set with the clients
+	regionalCloudWatch func(region string) (cloudwatchiface.CloudWatchAPI, error)
+	// the clients created by regionalCloudWatch, by region
+	regionalClients map[string]cloudwatchiface.CloudWatchAPI
+	// spaces out the GetMetricStatistics calls of all the CloudWatch clients, if set
+	rateLimiter *rateLimiter
+
+	// given to NewDynamoDBPluginWithSession, to create the clients from instead of the options
+	session        *session.Session
+	sessionConfigs []*aws.Config
+
+	// CloudWatch metrics without a datapoint to report in the last FetchMetrics, for the summary
+	emptyMetrics int
+
+	// periods of the metrics reported by the last FetchMetrics, by metric key, with EmitPeriod
+	periods map[string]int64
+
+	// timestamps of the datapoints reported by the last FetchMetrics, by metric key
+	timestamps map[string]time.Time
+
+	// clock, replaceable for testing
+	now func() time.Time
+	// applied to the provider of the assumed role credentials, e.g. to replace the STS client for testing
+	assumeRoleOptions []func(*stscreds.AssumeRoleProvider)
 }
 
 // MetricKeyPrefix interface for PluginWithPrefix
-func (p DynamoDBPlugin) MetricKeyPrefix() string {
-	if p.Prefix == "" {
-		p.Prefix = "dynamodb"
+// An empty Prefix resolves to defaultPrefix, and GraphDefinition labels use the same resolved prefix
+func (p *DynamoDBPlugin) MetricKeyPrefix() string {
+	prefix := p.Prefix
+	if prefix == "" {
+		prefix = defaultPrefix
+	}
+	if p.AccountID != "" {
+		prefix += "-" + p.AccountID
+	}
+	return sanitizeMetricKey(prefix)
+}
+
+var (
+	invalidMetricKeyChars     = regexp.MustCompile(`[^-a-zA-Z0-9_.]+`)
+	invalidMetricKeyPartChars = regexp.MustCompile(`[^-a-zA-Z0-9_]+`)
+	repeatedUnderscores       = regexp.MustCompile(`_{2,}`)
+)
+
+// circuitBreaker gives up a run after a number of consecutive transient CloudWatch failures, e.g. during a regional outage,
+// instead of trying every remaining metric in vain
+type circuitBreaker struct {
+	max      int
+	failures int
+	// all the failures in the run, for the summary
+	total int
+}
+
+// record counts the result of a call, and returns an error once max calls in a row have failed transiently (max 0 never gives up).
+// Other errors, e.g. AccessDenied for a single API, are answers of a working service and break the streak
+func (b *circuitBreaker) record(err error) error {
+	if err == nil {
+		b.failures = 0
+		return nil
+	}
+	b.total++
+	if !isTransientError(err) {
+		b.failures = 0
+		return nil
+	}
+	b.failures++
+	if b.max > 0 && b.failures >= b.max {
+		return fmt.Errorf("giving up after %d consecutive CloudWatch failures: %s", b.failures, err)
+	}
+	return nil
+}
+
+// isTransientError tells whether the error is of the service or the network rather than of the request:
+// throttling, a 5xx, a network error or a timeout
+func isTransientError(err error) bool {
+	if request.IsErrorThrottle(err) || request.IsErrorRetryable(err) {
+		return true
+	}
+	if reqErr, ok := err.(awserr.RequestFailure); ok && reqErr.StatusCode() >= 500 {
+		return true
+	}
+	awsErr, ok := err.(awserr.Error)
+	return ok && awsErr.Code() == request.CanceledErrorCode
+}
+
+// sanitizeMetricKey replaces characters Mackerel doesn't allow in metric keys with "_"
+func sanitizeMetricKey(key string) string {
+	return repeatedUnderscores.ReplaceAllString(invalidMetricKeyChars.ReplaceAllString(key, "_"), "_")
+}
+
+// sanitizeMetricKeyPart is sanitizeMetricKey for a dynamic name (operation, index, ...) embedded in a key,
+// where "." must be replaced too so that the name matches a single "#" or "*" of a wildcard metric
+func sanitizeMetricKeyPart(part string) string {
+	return repeatedUnderscores.ReplaceAllString(invalidMetricKeyPartChars.ReplaceAllString(part, "_"), "_")
+}
+
+// NewDynamoDBPluginWithSession returns a plugin for the table, collecting with a CloudWatch client created from sess and configs.
+// This is for host applications that already have an AWS session: the credential, region and retry options of the plugin
+// (AccessKeyID, Region, RoleARN, ...) are not used. The clients are created on the first FetchMetrics, and again after Reset
+func NewDynamoDBPluginWithSession(tableName string, sess *session.Session, configs ...*aws.Config) *DynamoDBPlugin {
+	return &DynamoDBPlugin{
+		TableName:      tableName,
+		session:        sess,
+		sessionConfigs: configs,
+	}
+}
+
+// prepareWithSession creates the clients from the session given to NewDynamoDBPluginWithSession
+func (p *DynamoDBPlugin) prepareWithSession() {
+	p.CloudWatch = p.limitRate(cloudwatch.New(p.session, p.sessionConfigs...))
+	p.regionalCloudWatch = func(region string) (cloudwatchiface.CloudWatchAPI, error) {
+		configs := append(append([]*aws.Config(nil), p.sessionConfigs...), aws.NewConfig().WithRegion(region))
+		return cloudwatch.New(p.session, configs...), nil
+	}
+	p.regionalClients = nil
+	p.DynamoDB = dynamodb.New(p.session, p.sessionConfigs...)
+	p.STS = sts.New(p.session, p.sessionConfigs...)
+}
+
+// limitRate wraps the CloudWatch client with the rate limiter of the plugin, if any
+func (p *DynamoDBPlugin) limitRate(cw cloudwatchiface.CloudWatchAPI) cloudwatchiface.CloudWatchAPI {
+	if p.rateLimiter == nil {
+		return cw
+	}
+	return &rateLimitedCloudWatch{CloudWatchAPI: cw, limiter: p.rateLimiter}
+}
+
+// WithMetricGroups appends metrics groups to be collected with the TableName dimension in addition to the defaults.
+// Their metrics are reported on the "Custom" graph, so MackerelName must not contain "."
+func (p *DynamoDBPlugin) WithMetricGroups(groups []MetricsGroup) *DynamoDBPlugin {
+	p.customMetricsGroups = append(p.customMetricsGroups, groups...)
+	return p
+}
+
+// currentTime returns the time from the injected clock, or time.Now
+func (p *DynamoDBPlugin) currentTime() time.Time {
+	if p.now != nil {
+		return p.now()
+	}
+	return time.Now()
+}
+
+// logRoutinef logs a routine message, such as a metric which legitimately doesn't exist for the table, unless Quiet
+func (p *DynamoDBPlugin) logRoutinef(format string, v ...interface{}) {
+	if !p.Quiet {
+		log.Printf(format, v...)
 	}
-	return p.Prefix
+}
+
+// Reset drops the AWS clients and the cached table description and graph definition,
+// so that the next FetchMetrics creates them again from the current options (e.g. after changing the credentials),
+// or from the session of NewDynamoDBPluginWithSession
+func (p *DynamoDBPlugin) Reset() {
+	p.CloudWatch = nil
+	p.DynamoDB = nil
+	p.STS = nil
+	p.regionalCloudWatch = nil
+	p.regionalClients = nil
+	p.tableDescription = nil
+	p.graphdefOnce = sync.Once{}
+	p.graphdef = nil
 }
 
 // prepare creates CloudWatch instance
 func (p *DynamoDBPlugin) prepare() error {
-	sess, err := session.NewSession()
+	if p.session != nil {
+		p.prepareWithSession()
+		return nil
+	}
+
+	opts := session.Options{}
+	if p.AWSConfigFile != "" {
+		f, err := os.Open(p.AWSConfigFile)
+		if err != nil {
+			return err
+		}
+		f.Close()
+		opts.SharedConfigFiles = []string{p.AWSConfigFile}
+		opts.SharedConfigState = session.SharedConfigEnable
+	}
+	sess, err := session.NewSessionWithOptions(opts)
 	if err != nil {
 		return err
 	}
@@ -67,9 +394,102 @@ func (p *DynamoDBPlugin) prepare() error {
 	if p.Region != "" {
 		config = config.WithRegion(p.Region)
 	}
+	if p.FIPS {
+		if p.Endpoint != "" {
+			return errors.New("-fips and -endpoint can't be used together")
+		}
+		region := p.Region
+		if region == "" {
+			region = aws.StringValue(sess.Config.Region)
+		}
+		// strict matching fails for the regions without the FIPS endpoint, rather than making up a host name
+		if _, err := endpoints.DefaultResolver().EndpointFor(cloudwatch.EndpointsID, region, func(o *endpoints.Options) {
+			o.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+			o.StrictMatching = true
+		}); err != nil {
+			return fmt.Errorf("no FIPS endpoint of CloudWatch in the region %s: %s", region, err)
+		}
+		config.UseFIPSEndpoint = endpoints.FIPSEndpointStateEnabled
+	}
+	if p.RoleARN != "" {
+		// the static keys above (or the default credential chain) are the base credentials calling sts:AssumeRole
+		config = config.WithCredentials(stscreds.NewCredentials(sess.Copy(config), p.RoleARN, p.assumeRoleOptions...))
+	}
+	// zero delays fall back to the SDK defaults
+	config = request.WithRetryer(config, retryAfterRetryer{client.DefaultRetryer{
+		NumMaxRetries:    client.DefaultRetryerMaxNumRetries,
+		MinRetryDelay:    p.RetryBaseDelay,
+		MinThrottleDelay: p.RetryBaseDelay,
+		MaxRetryDelay:    p.RetryMaxDelay,
+		MaxThrottleDelay: p.RetryMaxDelay,
+	}})
+
+	if p.SDKLogLevel != aws.LogOff {
+		// the standard logger writes to stderr, apart from the metrics on stdout
+		config = config.WithLogLevel(p.SDKLogLevel).WithLogger(aws.LoggerFunc(func(args ...interface{}) {
+			log.Println(args...)
+		}))
+	}
+
+	creds := config.Credentials
+	if creds == nil {
+		creds = sess.Config.Credentials
+	}
+	if err := checkCredentials(creds); err != nil {
+		return err
+	}
+
+	cwConfig := config
+	if p.Endpoint != "" {
+		// requests are still signed for the region, as the SDK takes the signing region from it for a custom endpoint
+		cwConfig = config.Copy().WithEndpoint(p.Endpoint)
+	}
+	cw := cloudwatch.New(sess, cwConfig)
+	if p.SigningRegion != "" {
+		// the signer takes the region of the client info over the one of the config
+		cw.ClientInfo.SigningRegion = p.SigningRegion
+	}
+	p.CloudWatch = p.limitRate(cw)
+	p.regionalCloudWatch = func(region string) (cloudwatchiface.CloudWatchAPI, error) {
+		// the endpoint and the signing region belong to the region of the plugin, and going around them could bypass a proxy
+		if p.Endpoint != "" || p.SigningRegion != "" {
+			return nil, fmt.Errorf("can't query CloudWatch in %s with -endpoint or -signing-region, which are for the region of the plugin", region)
+		}
+		return cloudwatch.New(sess, config.Copy().WithRegion(region)), nil
+	}
+	p.regionalClients = nil
+	p.DynamoDB = dynamodb.New(sess, config)
+	p.STS = sts.New(sess, config)
+
+	return nil
+}
 
-	p.CloudWatch = cloudwatch.New(sess, config)
+// checkCredentials retrieves the credentials, to fail early with a clear message when there are none
+// rather than with a generic error deep inside the first CloudWatch call
+func checkCredentials(creds *credentials.Credentials) error {
+	if _, err := creds.Get(); err != nil {
+		if awsErr, ok := err.(awserr.Error); ok && awsErr.Code() == "NoCredentialProviders" {
+			return errors.New("no AWS credentials found: set -access-key-id and -secret-access-key, AWS_ACCESS_KEY_ID and AWS_SECRET_ACCESS_KEY, a profile in the shared config, or an instance role")
+		}
+		return err
+	}
+	return nil
+}
 
+// resolveAccountID replaces AccountID "auto" with the account of the credentials, with sts:GetCallerIdentity.
+// It's called by FetchMetrics and Do before anything is output, and once resolved the account ID is not looked up again
+func (p *DynamoDBPlugin) resolveAccountID(ctx aws.Context) error {
+	if p.AccountID != accountIDAuto {
+		return nil
+	}
+	if p.STS == nil {
+		return errors.New("no STS client to resolve the account ID")
+	}
+	identity, err := p.STS.GetCallerIdentityWithContext(ctx, &sts.GetCallerIdentityInput{})
+	if err != nil {
+		return err
+	}
+	p.AccountID = aws.StringValue(identity.Account)
 	return nil
 }
 
@@ -91,8 +511,47 @@ func transformAndAppendDatapoint(dp *cloudwatch.Datapoint, dataType string, labe
 	return stats
 }
 
-// fetch metrics which takes "Operation" dimensions querying both ListMetrics and GetMetricsStatistics
-func fetchOperationWildcardMetrics(cw cloudwatchiface.CloudWatchAPI, mg metricsGroup, baseDimensions []*cloudwatch.Dimension) (map[string]interface{}, error) {
+// statistics which transformAndAppendDatapoint takes from a datapoint
+var supportedStatistics = map[string]bool{
+	metricsTypeAverage:     true,
+	metricsTypeSum:         true,
+	metricsTypeMaximum:     true,
+	metricsTypeMinimum:     true,
+	metricsTypeSampleCount: true,
+}
+
+// validateMetricsGroups checks the statistic of every metric, since an unknown one would silently yield no data
+func validateMetricsGroups(groups []MetricsGroup) error {
+	for _, mg := range groups {
+		for _, met := range mg.Metrics {
+			if !supportedStatistics[met.Type] {
+				return fmt.Errorf("unknown statistic %q for %s of %s", met.Type, met.MackerelName, mg.CloudWatchName)
+			}
+		}
+	}
+	return nil
+}
+
+// listMetrics calls ListMetrics following NextToken, as a page has up to 500 metrics
+func (p *DynamoDBPlugin) listMetrics(ctx aws.Context, input *cloudwatch.ListMetricsInput) ([]*cloudwatch.Metric, error) {
+	var metrics []*cloudwatch.Metric
+	for {
+		res, err := p.CloudWatch.ListMetricsWithContext(ctx, input)
+		if err != nil {
+			return nil, err
+		}
+		metrics = append(metrics, res.Metrics...)
+		if res.NextToken == nil {
+			return metrics, nil
+		}
+		input.NextToken = res.NextToken
+	}
+}
+
+// fetch metrics which takes an extra dimension (e.g. "Operation") querying both ListMetrics and GetMetricsStatistics into stats.
+// "#" in MackerelName is replaced with the value of the dimension.
+// Every call is recorded with the run, and a failed one doesn't stop the other values: only giving up the run is returned
+func (p *DynamoDBPlugin) fetchWildcardMetrics(run *fetchRun, mg MetricsGroup, baseDimensions []*cloudwatch.Dimension, dimensionName string, stats map[string]interface{}) error {
 	// get available dimensions
 	dimensionFilters := make([]*cloudwatch.DimensionFilter, len(baseDimensions))
 	for i, dimension := range baseDimensions {
@@ -106,215 +565,978 @@ func fetchOperationWildcardMetrics(cw cloudwatchiface.CloudWatchAPI, mg metricsG
 		Namespace:  aws.String(namespace),
 		MetricName: aws.String(mg.CloudWatchName),
 	}
-	// ListMetrics can retrieve up to 500 metrics, but DynamoDB Operations are apparently less than 500
-	res, err := cw.ListMetrics(input)
-	if err != nil {
-		return nil, err
+	cwMetrics, err := p.listMetrics(run.ctx, input)
+	if err := run.record(mg.CloudWatchName, err); err != nil {
+		return err
 	}
 
-	stats := make(map[string]interface{})
-
 	// get datapoints with retrieved dimensions
-	for _, cwMetric := range res.Metrics {
+	for _, cwMetric := range cwMetrics {
 		dimensions := cwMetric.Dimensions
-		// extract operation name
-		var operation *string
+		// extract operation or index name
+		var value *string
 		for _, d := range dimensions {
-			if *d.Name == "Operation" {
-				operation = d.Value
+			if *d.Name == dimensionName {
+				value = d.Value
 				break
 			}
 		}
-		if operation == nil {
-			log.Printf("Unexpected dimension, skip: %s", dimensions)
+		if value == nil {
+			// the metric for the whole table is listed too when it exists
+			if len(dimensions) != len(baseDimensions) {
+				p.logRoutinef("Unexpected dimension, skip: %s", dimensions)
+			}
+			continue
+		}
+		if dimensionName == "Operation" && p.Operations != nil && !p.Operations[*value] {
 			continue
 		}
 
-		dp, err := getLastPointFromCloudWatch(cw, mg, dimensions)
+		name := mg.CloudWatchName + " of " + *value
+		if run.skip(name) {
+			continue
+		}
+		dps, err := p.getLastPoints(run.ctx, p.CloudWatch, mg, dimensions)
+		if err := run.record(name, err); err != nil {
+			return err
+		}
 		if err != nil {
-			return nil, nil
+			continue
 		}
-		if dp != nil {
-			for _, met := range mg.Metrics {
-				label := strings.Replace(met.MackerelName, "#", *operation, 1)
-				stats = transformAndAppendDatapoint(dp, met.Type, label, stats)
+		for _, met := range mg.Metrics {
+			label := strings.Replace(met.MackerelName, "#", sanitizeMetricKeyPart(*value), 1)
+			dp := p.selectDatapoint(dps, met.Type)
+			if dp == nil {
+				p.emptyMetrics++
 			}
+			stats = transformAndAppendDatapoint(dp, met.Type, label, stats)
+			p.recordTimestamp(label, dp)
+			p.recordPeriod(label, mg, dp)
 		}
 	}
 
-	return stats, nil
+	return nil
+}
+
+// getLastPoints calls getLastPointsFromCloudWatch with cw, bounded by the timeout of the group
+func (p *DynamoDBPlugin) getLastPoints(ctx aws.Context, cw cloudwatchiface.CloudWatchAPI, mg MetricsGroup, dimensions []*cloudwatch.Dimension) ([]*cloudwatch.Datapoint, error) {
+	timeout := mg.Timeout
+	if timeout == 0 {
+		timeout = p.GroupTimeout
+	}
+	if timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+		defer cancel()
+	}
+	return getLastPointsFromCloudWatch(ctx, cw, mg, dimensions, p.currentTime(), p.CollectInterval)
 }
 
-// getLastPoint fetches a CloudWatch metric and parse
-func getLastPointFromCloudWatch(cw cloudwatchiface.CloudWatchAPI, metric metricsGroup, dimensions []*cloudwatch.Dimension) (*cloudwatch.Datapoint, error) {
-	now := time.Now()
+// getLastPoints fetches a CloudWatch metric and returns the datapoints in the window, the latest first
+func getLastPointsFromCloudWatch(ctx aws.Context, cw cloudwatchiface.CloudWatchAPI, metric MetricsGroup, dimensions []*cloudwatch.Dimension, now time.Time, interval time.Duration) ([]*cloudwatch.Datapoint, error) {
 	statsInput := make([]*string, len(metric.Metrics))
 	for i, typ := range metric.Metrics {
 		statsInput[i] = aws.String(typ.Type)
 	}
+	period := metric.period()
+	// 8 min, since some metrics are aggregated over 5 min, or 2 periods for longer periods,
+	// or 3 intervals of the runs so that a datapoint is found even after a missed run
+	lookback := time.Duration(480) * time.Second
+	if l := time.Duration(2*period) * time.Second; l > lookback {
+		lookback = l
+	}
+	if l := 3 * interval; l > lookback {
+		lookback = l
+	}
+	end := now
+	if metric.CompletePeriods {
+		// the datapoint of the current period covers only its beginning so far, and EndTime is exclusive
+		end = now.Truncate(time.Duration(period) * time.Second)
+	}
 	input := &cloudwatch.GetMetricStatisticsInput{
-		// 8 min, since some metrics are aggregated over 5 min
-		StartTime:  aws.Time(now.Add(time.Duration(480) * time.Second * -1)),
-		EndTime:    aws.Time(now),
+		StartTime:  aws.Time(end.Add(lookback * -1)),
+		EndTime:    aws.Time(end),
 		MetricName: aws.String(metric.CloudWatchName),
-		Period:     aws.Int64(60),
+		Period:     aws.Int64(period),
 		Statistics: statsInput,
 		Namespace:  aws.String(namespace),
 		Dimensions: dimensions,
 	}
-	response, err := cw.GetMetricStatistics(input)
+	response, err := cw.GetMetricStatisticsWithContext(ctx, input)
 	if err != nil {
 		return nil, err
 	}
 
 	datapoints := response.Datapoints
+	sort.Slice(datapoints, func(i, j int) bool {
+		return datapoints[j].Timestamp.Before(*datapoints[i].Timestamp)
+	})
+
+	return datapoints, nil
+}
+
+// selectDatapoint chooses the datapoint to report for the statistic from the datapoints, the latest first, following Select.
+// Datapoints newer than MinAge are ignored as they are likely incomplete.
+// With SkipLatest, Sum is taken from the second-latest datapoint if any, since the latest minute may still be partially aggregated
+func (p *DynamoDBPlugin) selectDatapoint(datapoints []*cloudwatch.Datapoint, dataType string) *cloudwatch.Datapoint {
+	if p.MinAge > 0 {
+		threshold := p.currentTime().Add(-p.MinAge)
+		for len(datapoints) > 0 && datapoints[0].Timestamp.After(threshold) {
+			datapoints = datapoints[1:]
+		}
+	}
 	if len(datapoints) == 0 {
-		return nil, nil
+		return nil
 	}
-
-	latest := new(time.Time)
-	var latestDp *cloudwatch.Datapoint
-	for _, dp := range datapoints {
-		if dp.Timestamp.Before(*latest) {
-			continue
+	switch p.Select {
+	case selectFirst:
+		return datapoints[len(datapoints)-1]
+	case selectMax:
+		var selected *cloudwatch.Datapoint
+		for _, dp := range datapoints {
+			v := statisticField(dp, dataType)
+			if v == nil || *v == nil {
+				continue
+			}
+			if selected == nil || **v > **statisticField(selected, dataType) {
+				selected = dp
+			}
 		}
-
-		latest = dp.Timestamp
-		latestDp = dp
+		return selected
+	case selectAvg:
+		var sum float64
+		var count int
+		for _, dp := range datapoints {
+			if v := statisticField(dp, dataType); v != nil && *v != nil {
+				sum += **v
+				count++
+			}
+		}
+		if count == 0 {
+			return nil
+		}
+		// a datapoint of its own, at the time of the latest one
+		avg := &cloudwatch.Datapoint{Timestamp: datapoints[0].Timestamp}
+		*statisticField(avg, dataType) = aws.Float64(sum / float64(count))
+		return avg
 	}
+	if p.SkipLatest && dataType == metricsTypeSum && len(datapoints) > 1 {
+		return datapoints[1]
+	}
+	return datapoints[0]
+}
 
-	return latestDp, nil
+// statisticField returns the field of the datapoint holding the statistic, or nil for an unknown statistic
+func statisticField(dp *cloudwatch.Datapoint, dataType string) **float64 {
+	switch dataType {
+	case metricsTypeAverage:
+		return &dp.Average
+	case metricsTypeSum:
+		return &dp.Sum
+	case metricsTypeMaximum:
+		return &dp.Maximum
+	case metricsTypeMinimum:
+		return &dp.Minimum
+	case metricsTypeSampleCount:
+		return &dp.SampleCount
+	}
+	return nil
 }
 
-var defaultMetricsGroup = []metricsGroup{
-	{CloudWatchName: "ConditionalCheckFailedRequests", Metrics: []metric{
-		{MackerelName: "ConditionalCheckFailedRequests", Type: metricsTypeSum},
+var defaultMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "ConditionalCheckFailedRequests", Metrics: []Metric{
+		{MackerelName: "ConditionalCheckFailedRequests", Type: metricsTypeSum, Optional: true},
 	}},
-	{CloudWatchName: "ConsumedReadCapacityUnits", Metrics: []metric{
+	{CloudWatchName: "ConsumedReadCapacityUnits", Metrics: []Metric{
 		{MackerelName: "ConsumedReadCapacityUnitsSum", Type: metricsTypeSum},
 		{MackerelName: "ConsumedReadCapacityUnitsAverage", Type: metricsTypeAverage},
 	}},
-	{CloudWatchName: "ConsumedWriteCapacityUnits", Metrics: []metric{
+	{CloudWatchName: "ConsumedWriteCapacityUnits", Metrics: []Metric{
 		{MackerelName: "ConsumedWriteCapacityUnitsSum", Type: metricsTypeSum},
 		{MackerelName: "ConsumedWriteCapacityUnitsAverage", Type: metricsTypeAverage},
 	}},
-	{CloudWatchName: "ProvisionedReadCapacityUnits", Metrics: []metric{
-		{MackerelName: "ProvisionedReadCapacityUnits", Type: metricsTypeMinimum},
+	{CloudWatchName: "ProvisionedReadCapacityUnits", Metrics: []Metric{
+		{MackerelName: "ProvisionedReadCapacityUnits", Type: metricsTypeMinimum, Optional: true},
+		{MackerelName: "ProvisionedReadCapacityUnitsAverage", Type: metricsTypeAverage, Optional: true},
 	}},
-	{CloudWatchName: "ProvisionedWriteCapacityUnits", Metrics: []metric{
-		{MackerelName: "ProvisionedWriteCapacityUnits", Type: metricsTypeMinimum},
+	{CloudWatchName: "ProvisionedWriteCapacityUnits", Metrics: []Metric{
+		{MackerelName: "ProvisionedWriteCapacityUnits", Type: metricsTypeMinimum, Optional: true},
+		{MackerelName: "ProvisionedWriteCapacityUnitsAverage", Type: metricsTypeAverage, Optional: true},
 	}},
-	{CloudWatchName: "SystemErrors", Metrics: []metric{
-		{MackerelName: "SystemErrors", Type: metricsTypeSum},
+	{CloudWatchName: "SystemErrors", Metrics: []Metric{
+		{MackerelName: "SystemErrors", Type: metricsTypeSum, Optional: true},
 	}},
-	{CloudWatchName: "UserErrors", Metrics: []metric{
-		{MackerelName: "UserErrors", Type: metricsTypeSum},
+	{CloudWatchName: "UserErrors", Metrics: []Metric{
+		{MackerelName: "UserErrors", Type: metricsTypeSum, Optional: true},
 	}},
-	{CloudWatchName: "WriteThrottleEvents", Metrics: []metric{
-		{MackerelName: "WriteThrottleEvents", Type: metricsTypeSum},
+	{CloudWatchName: "ReadThrottleEvents", Metrics: []Metric{
+		{MackerelName: "ReadThrottleEvents", Type: metricsTypeSum, Optional: true},
+		{MackerelName: "ReadThrottleEventsMaximum", Type: metricsTypeMaximum, Optional: true},
 	}},
+	{CloudWatchName: "WriteThrottleEvents", Metrics: []Metric{
+		{MackerelName: "WriteThrottleEvents", Type: metricsTypeSum, Optional: true},
+	}},
+}
+
+// DefaultMetricsGroups returns a copy of the metrics groups collected for a table by default
+func DefaultMetricsGroups() []MetricsGroup {
+	groups := make([]MetricsGroup, len(defaultMetricsGroup))
+	for i, mg := range defaultMetricsGroup {
+		groups[i] = mg
+		groups[i].Metrics = append([]Metric(nil), mg.Metrics...)
+	}
+	return groups
 }
 
-var operationalMetricsGroup = []metricsGroup{
-	{CloudWatchName: "SuccessfulRequestLatency", Metrics: []metric{
+var operationalMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "SuccessfulRequestLatency", Metrics: []Metric{
 		{MackerelName: "SuccessfulRequests.#", Type: metricsTypeSampleCount},
 		{MackerelName: "SuccessfulRequestLatency.#.Minimum", Type: metricsTypeMinimum},
 		{MackerelName: "SuccessfulRequestLatency.#.Maximum", Type: metricsTypeMaximum},
 		{MackerelName: "SuccessfulRequestLatency.#.Average", Type: metricsTypeAverage},
 	}},
-	{CloudWatchName: "ThrottledRequests", Metrics: []metric{
+	{CloudWatchName: "ThrottledRequests", Metrics: []Metric{
 		{MackerelName: "ThrottledRequests.#", Type: metricsTypeSampleCount},
 	}},
-	{CloudWatchName: "SystemErrors", Metrics: []metric{
+	{CloudWatchName: "SystemErrors", Metrics: []Metric{
 		{MackerelName: "SystemErrors.#", Type: metricsTypeSampleCount},
 	}},
-	{CloudWatchName: "UserErrors", Metrics: []metric{
+	{CloudWatchName: "UserErrors", Metrics: []Metric{
 		{MackerelName: "UserErrors.#", Type: metricsTypeSampleCount},
 	}},
 }
 
-// FetchMetrics fetch the metrics
-func (p DynamoDBPlugin) FetchMetrics() (map[string]interface{}, error) {
-	stats := make(map[string]interface{})
+// metrics per global secondary index
+var indexMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "ReadThrottleEvents", Metrics: []Metric{
+		{MackerelName: "ThrottledEvents.#.Read", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "WriteThrottleEvents", Metrics: []Metric{
+		{MackerelName: "ThrottledEvents.#.Write", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ConsumedReadCapacityUnits", Metrics: []Metric{
+		{MackerelName: "ReadCapacity.#.ConsumedSum", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ConsumedWriteCapacityUnits", Metrics: []Metric{
+		{MackerelName: "WriteCapacity.#.ConsumedSum", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ProvisionedReadCapacityUnits", Metrics: []Metric{
+		{MackerelName: "ReadCapacity.#.Provisioned", Type: metricsTypeAverage},
+	}},
+	{CloudWatchName: "ProvisionedWriteCapacityUnits", Metrics: []Metric{
+		{MackerelName: "WriteCapacity.#.Provisioned", Type: metricsTypeAverage},
+	}},
+}
 
-	tableDimensions := []*cloudwatch.Dimension{{
-		Name:  aws.String("TableName"),
-		Value: aws.String(p.TableName),
-	}}
-	for _, met := range defaultMetricsGroup {
-		dp, err := getLastPointFromCloudWatch(p.CloudWatch, met, tableDimensions)
-		if err == nil {
-			for _, m := range met.Metrics {
-				stats = transformAndAppendDatapoint(dp, m.Type, m.MackerelName, stats)
-			}
-		} else {
-			log.Printf("%s: %s", met, err)
+// Kinesis Data Streams destination metrics per DelegatedOperation, which are collected only with Stream
+var streamMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "AgeOfOldestUnreplicatedRecord", Metrics: []Metric{
+		{MackerelName: "StreamReplicationAge.#", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "FailedToReplicateRecordCount", Metrics: []Metric{
+		{MackerelName: "StreamReplicationFailures.#", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ConsumedChangeDataCaptureUnits", Metrics: []Metric{
+		{MackerelName: "CDC.#", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ThrottledPutRecordCount", Metrics: []Metric{
+		{MackerelName: "StreamThrottledPutRecords.#", Type: metricsTypeSum},
+	}},
+}
+
+// global table replication metrics per ReceivingRegion, which are collected only with Replication
+var replicationMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "ReplicationLatency", Metrics: []Metric{
+		{MackerelName: "ReplicationLatency.#.Average", Type: metricsTypeAverage},
+		{MackerelName: "ReplicationLatency.#.Maximum", Type: metricsTypeMaximum},
+		{MackerelName: "ReplicationLatency.#.Minimum", Type: metricsTypeMinimum},
+	}},
+}
+
+// hourly consumed capacity of the last complete hour, which are collected only with Trend
+var trendMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "ConsumedReadCapacityUnits", Period: 3600, CompletePeriods: true, Metrics: []Metric{
+		{MackerelName: "ConsumedReadCapacityUnitsHourlySum", Type: metricsTypeSum},
+	}},
+	{CloudWatchName: "ConsumedWriteCapacityUnits", Period: 3600, CompletePeriods: true, Metrics: []Metric{
+		{MackerelName: "ConsumedWriteCapacityUnitsHourlySum", Type: metricsTypeSum},
+	}},
+}
+
+// account-wide metrics, which are collected only with AccountMetrics
+var accountMetricsGroup = []MetricsGroup{
+	{CloudWatchName: "AccountMaxTableLevelReads", Metrics: []Metric{
+		{MackerelName: "AccountMaxTableLevelReads", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "AccountMaxTableLevelWrites", Metrics: []Metric{
+		{MackerelName: "AccountMaxTableLevelWrites", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "AccountProvisionedReadCapacityUtilization", Metrics: []Metric{
+		{MackerelName: "AccountProvisionedReadCapacityUtilizationAverage", Type: metricsTypeAverage},
+		{MackerelName: "AccountProvisionedReadCapacityUtilizationMaximum", Type: metricsTypeMaximum},
+	}},
+	{CloudWatchName: "AccountProvisionedWriteCapacityUtilization", Metrics: []Metric{
+		{MackerelName: "AccountProvisionedWriteCapacityUtilizationAverage", Type: metricsTypeAverage},
+		{MackerelName: "AccountProvisionedWriteCapacityUtilizationMaximum", Type: metricsTypeMaximum},
+	}},
+}
+
+// accountKey returns the graph or metric key of an account metric, under accountSubPrefix with AccountSubPrefix
+func (p *DynamoDBPlugin) accountKey(key string) string {
+	if p.AccountSubPrefix {
+		return accountSubPrefix + "." + key
+	}
+	return key
+}
+
+// fetchRun is the state of a FetchMetrics shared by its CloudWatch calls
+type fetchRun struct {
+	// canceled at TotalTimeout
+	ctx     aws.Context
+	breaker circuitBreaker
+}
+
+// skip tells whether the call is to be skipped as the run exceeded the total timeout.
+// Past the deadline, what has been collected so far is reported
+func (r *fetchRun) skip(name string) bool {
+	if r.ctx.Err() == nil {
+		return false
+	}
+	log.Printf("%s: skipped, the run exceeded the total timeout", name)
+	return true
+}
+
+// record logs the error of the call if any and counts it with the breaker, returning an error to give up the run
+func (r *fetchRun) record(name string, err error) error {
+	if err != nil {
+		log.Printf("%s: %s", name, err)
+	}
+	return r.breaker.record(err)
+}
+
+// collected returns the table metrics groups selected by MetricsFor
+func (p *DynamoDBPlugin) collected(groups []MetricsGroup) []MetricsGroup {
+	var selected []MetricsGroup
+	for _, mg := range groups {
+		if p.collects(mg) {
+			selected = append(selected, mg)
 		}
 	}
+	return selected
+}
 
-	for _, met := range operationalMetricsGroup {
-		operationalStats, err := fetchOperationWildcardMetrics(p.CloudWatch, met, tableDimensions)
-		if err == nil {
-			for name, s := range operationalStats {
-				stats[name] = s
+// fetchGroups fetches the metrics groups with the dimensions into stats, each value of dimensionName separately unless it's empty.
+// It returns the number of datapoints in the window by CloudWatch metric name for the groups without dimensionName,
+// or an error only when the run gives up
+func (p *DynamoDBPlugin) fetchGroups(run *fetchRun, groups []MetricsGroup, dimensions []*cloudwatch.Dimension, dimensionName string, stats map[string]interface{}) (map[string]int, error) {
+	counts := make(map[string]int)
+	for _, met := range groups {
+		if run.skip(met.CloudWatchName) {
+			continue
+		}
+		if dimensionName != "" {
+			if err := p.fetchWildcardMetrics(run, met, dimensions, dimensionName, stats); err != nil {
+				return nil, err
 			}
-		} else {
-			log.Printf("%s: %s", met, err)
+			continue
+		}
+		count, err := p.fetchLastPoints(run.ctx, met, dimensions, stats)
+		if err := run.record(met.CloudWatchName, err); err != nil {
+			return nil, err
+		}
+		if err == nil {
+			counts[met.CloudWatchName] = count
 		}
 	}
-	return transformMetrics(stats), nil
+	return counts, nil
 }
 
-// TransformMetrics converts some of datapoints to post differences of two metrics
-func transformMetrics(stats map[string]interface{}) map[string]interface{} {
-	// Although stats are interface{}, those values from cloudwatch.Datapoint are guaranteed to be numerical
-	if consumedReadCapacitySum, ok := stats["ConsumedReadCapacityUnitsSum"].(float64); ok {
-		stats["ConsumedReadCapacityUnitsNormalized"] = consumedReadCapacitySum / 60.0
+// fetchLastPoints fetches a metrics group and appends its latest values to stats.
+// It returns the number of datapoints in the window
+func (p *DynamoDBPlugin) fetchLastPoints(ctx aws.Context, met MetricsGroup, dimensions []*cloudwatch.Dimension, stats map[string]interface{}) (int, error) {
+	dps, err := p.getLastPoints(ctx, p.CloudWatch, met, dimensions)
+	if err != nil {
+		return 0, err
 	}
-	if consumedWriteCapacitySum, ok := stats["ConsumedWriteCapacityUnitsSum"].(float64); ok {
-		stats["ConsumedWriteCapacityUnitsNormalized"] = consumedWriteCapacitySum / 60.0
+	for _, m := range met.Metrics {
+		dp := p.selectDatapoint(dps, m.Type)
+		if dp == nil {
+			p.emptyMetrics++
+		}
+		transformAndAppendDatapoint(dp, m.Type, m.MackerelName, stats)
+		p.recordTimestamp(m.MackerelName, dp)
+		p.recordPeriod(m.MackerelName, met, dp)
 	}
-	return stats
+	return len(dps), nil
 }
 
-// GraphDefinition of DynamoDBPlugin
-func (p DynamoDBPlugin) GraphDefinition() map[string]mp.Graphs {
-	labelPrefix := strings.Title(p.Prefix)
-	labelPrefix = strings.Replace(labelPrefix, "-", " ", -1)
+// presets for -metrics-for, listing CloudWatch metric names of the table metrics
+var metricsPresets = map[string][]string{
+	"capacity": {
+		"ConsumedReadCapacityUnits", "ConsumedWriteCapacityUnits",
+		"ProvisionedReadCapacityUnits", "ProvisionedWriteCapacityUnits",
+		"ReadThrottleEvents", "WriteThrottleEvents",
+	},
+	"errors":  {"ConditionalCheckFailedRequests", "SystemErrors", "UserErrors", "ThrottledRequests"},
+	"latency": {"SuccessfulRequestLatency"},
+	"all":     nil,
+}
 
-	var graphdef = map[string]mp.Graphs{
-		"ReadCapacity": {
-			Label: (labelPrefix + " Read Capacity Units"),
-			Unit:  "float",
-			Metrics: []mp.Metrics{
-				{Name: "ProvisionedReadCapacityUnits", Label: "Provisioned"},
-				{Name: "ConsumedReadCapacityUnitsNormalized", Label: "Consumed"},
-				{Name: "ConsumedReadCapacityUnitsAverage", Label: "Consumed (Average per request)"},
-			},
-		},
-		"WriteCapacity": {
-			Label: (labelPrefix + " Write Capacity Units"),
-			Unit:  "float",
-			Metrics: []mp.Metrics{
-				{Name: "ProvisionedWriteCapacityUnits", Label: "Provisioned"},
-				{Name: "ConsumedWriteCapacityUnitsNormalized", Label: "Consumed"},
-				{Name: "ConsumedWriteCapacityUnitsAverage", Label: "Consumed (Average per request)"},
-			},
-		},
-		"ThrottledEvents": {
-			Label: (labelPrefix + " Throttle Events"),
-			Unit:  "integer",
-			Metrics: []mp.Metrics{
-				{Name: "ReadThrottleEvents", Label: "Read"},
-				{Name: "WriteThrottleEvents", Label: "Write"},
-			},
-		},
-		"ConditionalCheckFailedRequests": {
-			Label: (labelPrefix + " ConditionalCheckFailedRequests"),
-			Unit:  "integer",
-			Metrics: []mp.Metrics{
-				{Name: "ConditionalCheckFailedRequests", Label: "Counts"},
-			},
+// operations which DynamoDB reports metrics with the Operation dimension for
+var knownOperations = []string{
+	"GetItem", "PutItem", "UpdateItem", "DeleteItem", "Query", "Scan", "BatchGetItem", "BatchWriteItem",
+	"TransactGetItems", "TransactWriteItems", "GetRecords",
+	"ExecuteStatement", "BatchExecuteStatement", "ExecuteTransaction",
+	"PartiQLSelect", "PartiQLInsert", "PartiQLUpdate", "PartiQLDelete",
+}
+
+// graphs of the latency metrics, which are reported in milliseconds by CloudWatch
+var latencyGraphs = []string{"SuccessfulRequestLatency.#", "ReplicationLatency.#"}
+
+// isLatencyMetric tells whether the metric is drawn on one of latencyGraphs
+func isLatencyMetric(name string) bool {
+	for _, graph := range latencyGraphs {
+		if strings.HasPrefix(name, strings.TrimSuffix(graph, "#")) {
+			return true
+		}
+	}
+	return false
+}
+
+// names of the SDK log levels for -sdk-log-level
+var sdkLogLevels = map[string]aws.LogLevelType{
+	"off":                        aws.LogOff,
+	"debug":                      aws.LogDebug,
+	"debug-with-signing":         aws.LogDebugWithSigning,
+	"debug-with-http-body":       aws.LogDebugWithHTTPBody,
+	"debug-with-request-retries": aws.LogDebugWithRequestRetries,
+	"debug-with-request-errors":  aws.LogDebugWithRequestErrors,
+}
+
+// resolveOperations validates the operation names to collect, returning nil to collect all for no names
+func resolveOperations(operations []string) (map[string]bool, error) {
+	known := make(map[string]bool, len(knownOperations))
+	for _, op := range knownOperations {
+		known[op] = true
+	}
+	resolved := make(map[string]bool, len(operations))
+	for _, op := range operations {
+		if op == "" {
+			continue
+		}
+		if !known[op] {
+			return nil, fmt.Errorf("unknown operation for -operations: %s", op)
+		}
+		resolved[op] = true
+	}
+	if len(resolved) == 0 {
+		return nil, nil
+	}
+	return resolved, nil
+}
+
+// resolveMetricsPresets returns CloudWatch metric names to collect for the presets, or nil to collect all
+func resolveMetricsPresets(presets []string) (map[string]bool, error) {
+	names := make(map[string]bool)
+	for _, preset := range presets {
+		metricNames, ok := metricsPresets[preset]
+		if !ok {
+			return nil, fmt.Errorf("unknown preset for -metrics-for: %s", preset)
+		}
+		if metricNames == nil {
+			return nil, nil
+		}
+		for _, name := range metricNames {
+			names[name] = true
+		}
+	}
+	if len(names) == 0 {
+		return nil, nil
+	}
+	return names, nil
+}
+
+// collects reports whether the table metrics group is selected by MetricsFor
+func (p *DynamoDBPlugin) collects(mg MetricsGroup) bool {
+	return p.MetricsFor == nil || p.MetricsFor[mg.CloudWatchName]
+}
+
+// throttled reports whether the table or its indexes had throttle events.
+// It is true when the throttle events are not collected, not to skip ThrottledRequests blindly
+func (p *DynamoDBPlugin) throttled(stats map[string]interface{}) bool {
+	if p.MetricsFor != nil && !(p.MetricsFor["ReadThrottleEvents"] && p.MetricsFor["WriteThrottleEvents"]) {
+		return true
+	}
+	for name, value := range stats {
+		if name != "ReadThrottleEvents" && name != "WriteThrottleEvents" && !strings.HasPrefix(name, "ThrottledEvents.") {
+			continue
+		}
+		if v, ok := value.(float64); ok && v > 0 {
+			return true
+		}
+	}
+	return false
+}
+
+// recordTimestamp remembers the timestamp of the datapoint reported as the metric
+func (p *DynamoDBPlugin) recordTimestamp(name string, dp *cloudwatch.Datapoint) {
+	if dp != nil && dp.Timestamp != nil && p.timestamps != nil {
+		p.timestamps[name] = *dp.Timestamp
+	}
+}
+
+// recordPeriod remembers the period of the metric with a datapoint, for EmitPeriod
+func (p *DynamoDBPlugin) recordPeriod(name string, mg MetricsGroup, dp *cloudwatch.Datapoint) {
+	if dp != nil && p.periods != nil {
+		p.periods[name] = mg.period()
+	}
+}
+
+// copyTimestamp gives a derived metric the timestamp of its source metric
+func (p *DynamoDBPlugin) copyTimestamp(from, to string) {
+	if t, ok := p.timestamps[from]; ok {
+		p.timestamps[to] = t
+	}
+}
+
+// renameTimestamp follows a rename of the metric key
+func (p *DynamoDBPlugin) renameTimestamp(from, to string) {
+	if t, ok := p.timestamps[from]; ok {
+		delete(p.timestamps, from)
+		p.timestamps[to] = t
+	}
+}
+
+// tableDimensions returns the dimensions specifying the table
+func (p *DynamoDBPlugin) tableDimensions() []*cloudwatch.Dimension {
+	dimensions := []*cloudwatch.Dimension{{
+		Name:  aws.String("TableName"),
+		Value: aws.String(p.TableName),
+	}}
+	return append(dimensions, p.Dimensions...)
+}
+
+// FetchMetrics fetch the metrics
+func (p *DynamoDBPlugin) FetchMetrics() (map[string]interface{}, error) {
+	// the built-in groups are known to be valid
+	if err := validateMetricsGroups(p.customMetricsGroups); err != nil {
+		return nil, err
+	}
+	// SEARCH expressions find the metrics of the monitoring account only, which would be reported as the ones of OwningAccount
+	if p.OwningAccount != "" && p.AggregateAllTables {
+		return nil, errors.New("-owning-account can't be used with -aggregate-all-tables, whose SEARCH queries read the monitoring account only")
+	}
+	// library users may leave the clients to be created from the options, once for all the calls
+	if p.CloudWatch == nil {
+		if err := p.prepare(); err != nil {
+			return nil, err
+		}
+	}
+	if err := p.resolveAccountID(context.Background()); err != nil {
+		return nil, err
+	}
+
+	startedAt := p.currentTime()
+	stats := make(map[string]interface{})
+	p.timestamps = make(map[string]time.Time)
+	p.emptyMetrics = 0
+	if p.EmitPeriod {
+		p.periods = make(map[string]int64)
+	}
+
+	ctx := context.Background()
+	if p.TotalTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, p.TotalTimeout)
+		defer cancel()
+	}
+	run := &fetchRun{ctx: ctx, breaker: circuitBreaker{max: p.MaxConsecutiveFailures}}
+
+	tableDimensions := p.tableDimensions()
+	counts, err := p.fetchGroups(run, p.collected(defaultMetricsGroup), tableDimensions, "", stats)
+	if err != nil {
+		return nil, err
+	}
+	// a consistently low count tells the period or window doesn't fit the metric
+	for name, count := range counts {
+		stats["PluginInternal.Datapoints."+name] = float64(count)
+	}
+
+	if p.Trend {
+		if _, err := p.fetchGroups(run, trendMetricsGroup, tableDimensions, "", stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.AccountMetrics {
+		// account metrics have no dimensions
+		if _, err := p.fetchGroups(run, accountMetricsGroup, nil, "", stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if _, err := p.fetchGroups(run, p.collected(indexMetricsGroup), tableDimensions, "GlobalSecondaryIndexName", stats); err != nil {
+		return nil, err
+	}
+	var operationalGroups []MetricsGroup
+	for _, met := range p.collected(operationalMetricsGroup) {
+		// fan out ThrottledRequests to operations only when the table is throttled, to save calls on healthy tables
+		if met.CloudWatchName == "ThrottledRequests" && !p.throttled(stats) {
+			continue
+		}
+		operationalGroups = append(operationalGroups, met)
+	}
+	if _, err := p.fetchGroups(run, operationalGroups, tableDimensions, "Operation", stats); err != nil {
+		return nil, err
+	}
+	if p.Stream {
+		if _, err := p.fetchGroups(run, streamMetricsGroup, tableDimensions, "DelegatedOperation", stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Replication {
+		if _, err := p.fetchGroups(run, replicationMetricsGroup, tableDimensions, "ReceivingRegion", stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.Utilization && !run.skip("GetMetricData") {
+		if err := run.record("GetMetricData", p.fetchMetricData(ctx, utilizationQueries(tableDimensions), stats)); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.AggregateAllTables && !run.skip("GetMetricData") {
+		if err := run.record("GetMetricData", p.fetchMetricData(ctx, allTablesQueries(), stats)); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.GlobalTable && !run.skip("DescribeTable") {
+		if err := p.fetchGlobalTableMetrics(run, stats); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.BillingMode && !run.skip("DescribeTable") {
+		payPerRequest, err := p.payPerRequest(ctx)
+		if err != nil {
+			log.Printf("DescribeTable: %s", err)
+		} else if payPerRequest {
+			stats["BillingModePayPerRequest"] = 1.0
+		} else {
+			stats["BillingModePayPerRequest"] = 0.0
+		}
+	}
+
+	customStats := make(map[string]interface{})
+	if _, err := p.fetchGroups(run, p.customMetricsGroups, tableDimensions, "", customStats); err != nil {
+		return nil, err
+	}
+	for name, s := range customStats {
+		stats["Custom."+name] = s
+		p.renameTimestamp(name, "Custom."+name)
+		if period, ok := p.periods[name]; ok {
+			delete(p.periods, name)
+			p.periods["Custom."+name] = period
+		}
+	}
+	if p.EmitPeriod {
+		for name, period := range p.periods {
+			// a single key segment, to be drawn by the wildcard graph
+			stats["PluginInternal.Period."+strings.Replace(name, ".", "_", -1)] = float64(period)
+		}
+	}
+
+	// how stale CloudWatch data is, taking ConsumedReadCapacityUnits as representative
+	if t, ok := p.timestamps["ConsumedReadCapacityUnitsAverage"]; ok {
+		stats["MetricLagSeconds"] = startedAt.Sub(t).Seconds()
+	}
+	stats["PluginRunDurationSeconds"] = p.currentTime().Sub(startedAt).Seconds()
+	// constant 1, telling by the key which version is reporting
+	stats["PluginInternal.BuildInfo."+sanitizeMetricKeyPart(Version)] = 1.0
+
+	if p.Strict {
+		var missing []string
+		for _, met := range defaultMetricsGroup {
+			if !p.collects(met) {
+				continue
+			}
+			for _, m := range met.Metrics {
+				if _, ok := stats[m.MackerelName]; !ok && !m.Optional {
+					missing = append(missing, m.MackerelName)
+				}
+			}
+		}
+		for _, met := range p.customMetricsGroups {
+			for _, m := range met.Metrics {
+				if _, ok := stats["Custom."+m.MackerelName]; !ok && !m.Optional {
+					missing = append(missing, "Custom."+m.MackerelName)
+				}
+			}
+		}
+		if len(missing) > 0 {
+			return nil, fmt.Errorf("no datapoint for the required metrics of %s: %s", p.TableName, strings.Join(missing, ", "))
+		}
+	}
+
+	if p.AssertProvisioned {
+		// on-demand tables have no provisioned capacity metrics, so they never fail here
+		for _, name := range []string{"ProvisionedReadCapacityUnits", "ProvisionedWriteCapacityUnits"} {
+			if v, ok := stats[name].(float64); ok && v == 0 {
+				return nil, fmt.Errorf("%s of %s is zero", name, p.TableName)
+			}
+		}
+	}
+
+	stats = p.transformMetrics(stats)
+	for _, name := range p.NaNMetrics {
+		if _, ok := stats[name]; !ok {
+			stats[name] = math.NaN()
+		}
+	}
+	if p.CloudWatchNames {
+		names := cloudWatchStyleNames()
+		for name, value := range stats {
+			if cwName, ok := names[name]; ok {
+				delete(stats, name)
+				stats[cwName] = value
+				p.renameTimestamp(name, cwName)
+			}
+		}
+	}
+	stats = p.sanitizeStats(stats)
+	if p.LastValuesFile != "" {
+		if err := dropUnchanged(p.LastValuesFile, stats); err != nil {
+			log.Printf("Failed to compare with the last values, report all: %s", err)
+		}
+	}
+	if p.Verbose {
+		log.Printf("collected %d, empty %d, errored %d", len(stats), p.emptyMetrics, run.breaker.total)
+	}
+	return stats, nil
+}
+
+// cloudWatchStyleNames maps the Mackerel names of the table metrics to the CloudWatch metric names with the statistic,
+// e.g. ConsumedReadCapacityUnitsSum to ConsumedReadCapacityUnits_Sum
+func cloudWatchStyleNames() map[string]string {
+	names := make(map[string]string)
+	for _, mg := range defaultMetricsGroup {
+		for _, m := range mg.Metrics {
+			names[m.MackerelName] = mg.CloudWatchName + "_" + m.Type
+		}
+	}
+	return names
+}
+
+// sanitizeStats applies sanitizeMetricKey to all keys of stats (and their timestamps)
+// When two keys collide after sanitization, the one which sorts first wins
+func (p *DynamoDBPlugin) sanitizeStats(stats map[string]interface{}) map[string]interface{} {
+	names := make([]string, 0, len(stats))
+	for name := range stats {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	sanitized := make(map[string]interface{}, len(stats))
+	for _, name := range names {
+		key := sanitizeMetricKey(name)
+		if _, ok := sanitized[key]; ok {
+			log.Printf("Duplicated metric key after sanitization, skip: %s", name)
+			continue
+		}
+		sanitized[key] = stats[name]
+		p.renameTimestamp(name, key)
+	}
+	return sanitized
+}
+
+// TransformMetrics converts some of datapoints to post differences of two metrics
+func (p *DynamoDBPlugin) transformMetrics(stats map[string]interface{}) map[string]interface{} {
+	// Although stats are interface{}, those values from cloudwatch.Datapoint are guaranteed to be numerical
+	if consumedReadCapacitySum, ok := stats["ConsumedReadCapacityUnitsSum"].(float64); ok {
+		stats["ConsumedReadCapacityUnitsNormalized"] = consumedReadCapacitySum / metricsPeriod
+		p.copyTimestamp("ConsumedReadCapacityUnitsSum", "ConsumedReadCapacityUnitsNormalized")
+	}
+	if consumedWriteCapacitySum, ok := stats["ConsumedWriteCapacityUnitsSum"].(float64); ok {
+		stats["ConsumedWriteCapacityUnitsNormalized"] = consumedWriteCapacitySum / metricsPeriod
+		p.copyTimestamp("ConsumedWriteCapacityUnitsSum", "ConsumedWriteCapacityUnitsNormalized")
+	}
+	// skipped when either is missing, rather than reporting a total which is actually one side
+	read, readOK := stats["ConsumedReadCapacityUnitsNormalized"].(float64)
+	write, writeOK := stats["ConsumedWriteCapacityUnitsNormalized"].(float64)
+	if readOK && writeOK {
+		stats["ConsumedCapacityUnitsTotalNormalized"] = read + write
+		p.copyTimestamp("ConsumedReadCapacityUnitsNormalized", "ConsumedCapacityUnitsTotalNormalized")
+	}
+	if p.AveragePerSecond {
+		// unlike the Sum-normalized values, these are not throughputs, as Average is per request
+		for _, name := range []string{"ConsumedReadCapacityUnitsAverage", "ConsumedWriteCapacityUnitsAverage"} {
+			if average, ok := stats[name].(float64); ok {
+				stats[name+"PerSecond"] = average / metricsPeriod
+				p.copyTimestamp(name, name+"PerSecond")
+			}
+		}
+	}
+	if p.ReadConsistencyFactor > 0 {
+		// one read capacity unit is a strongly consistent read of up to 4 KB per second
+		if consumedReadCapacity, ok := stats["ConsumedReadCapacityUnitsNormalized"].(float64); ok {
+			stats["EstimatedReadBytesPerSecond"] = consumedReadCapacity * readCapacityUnitBytes * p.ReadConsistencyFactor
+			p.copyTimestamp("ConsumedReadCapacityUnitsNormalized", "EstimatedReadBytesPerSecond")
+		}
+	}
+	if consumedReadCapacityHourlySum, ok := stats["ConsumedReadCapacityUnitsHourlySum"].(float64); ok {
+		stats["ConsumedReadCapacityUnitsHourlyNormalized"] = consumedReadCapacityHourlySum / 3600.0
+		p.copyTimestamp("ConsumedReadCapacityUnitsHourlySum", "ConsumedReadCapacityUnitsHourlyNormalized")
+	}
+	if consumedWriteCapacityHourlySum, ok := stats["ConsumedWriteCapacityUnitsHourlySum"].(float64); ok {
+		stats["ConsumedWriteCapacityUnitsHourlyNormalized"] = consumedWriteCapacityHourlySum / 3600.0
+		p.copyTimestamp("ConsumedWriteCapacityUnitsHourlySum", "ConsumedWriteCapacityUnitsHourlyNormalized")
+	}
+	if p.NormalizedOnly {
+		// the per-second values carry the same information as the sums
+		for _, name := range []string{
+			"ConsumedReadCapacityUnitsSum", "ConsumedWriteCapacityUnitsSum",
+			"ConsumedReadCapacityUnitsHourlySum", "ConsumedWriteCapacityUnitsHourlySum",
+		} {
+			delete(stats, name)
+			delete(p.timestamps, name)
+		}
+	}
+	// per-index consumed capacity, e.g. ReadCapacity.<index>.ConsumedSum
+	for name, value := range stats {
+		if !strings.HasSuffix(name, ".ConsumedSum") {
+			continue
+		}
+		if consumedSum, ok := value.(float64); ok {
+			normalizedName := strings.TrimSuffix(name, "Sum")
+			stats[normalizedName] = consumedSum / metricsPeriod
+			p.copyTimestamp(name, normalizedName)
+		}
+		if p.NormalizedOnly {
+			delete(stats, name)
+			delete(p.timestamps, name)
+		}
+	}
+	// SampleCount of SuccessfulRequestLatency is the number of requests in the period
+	for name, value := range stats {
+		if !strings.HasPrefix(name, "SuccessfulRequests.") {
+			continue
+		}
+		if requests, ok := value.(float64); ok {
+			rateName := "RequestRate." + strings.TrimPrefix(name, "SuccessfulRequests.")
+			stats[rateName] = requests / metricsPeriod
+			p.copyTimestamp(name, rateName)
+		}
+	}
+
+	if p.LatencySeconds {
+		for name, value := range stats {
+			if !isLatencyMetric(name) {
+				continue
+			}
+			if v, ok := value.(float64); ok {
+				stats[name] = v / 1000
+			}
+		}
+	}
+
+	// the requests are the successful ones of all the operations (SuccessfulRequests.<op>) and the user errors,
+	// so the rate is skipped when Operations leaves some operations out
+	if userErrors, ok := stats["UserErrors"].(float64); ok && p.Operations == nil {
+		var successful float64
+		var found bool
+		for name, value := range stats {
+			if v, ok := value.(float64); ok && strings.HasPrefix(name, "SuccessfulRequests.") {
+				successful += v
+				found = true
+			}
+		}
+		if requests := successful + userErrors; found && requests > 0 {
+			stats["UserErrorRate"] = userErrors / requests * 100
+			p.copyTimestamp("UserErrors", "UserErrorRate")
+		}
+	}
+
+	// scaling is purely cosmetic, e.g. to show consumed capacity per hour
+	if p.Scale != 0 && p.Scale != 1 {
+		for _, name := range p.ScaleMetrics {
+			value, ok := stats[name]
+			if !ok {
+				continue
+			}
+			if v, ok := value.(float64); ok {
+				stats[name] = v * p.Scale
+			} else {
+				log.Printf("Non-numerical value, skip scaling: %s", name)
+			}
+		}
+	}
+	return stats
+}
+
+// GraphDefinition of DynamoDBPlugin
+func (p *DynamoDBPlugin) GraphDefinition() map[string]mp.Graphs {
+	// the labels take the account ID, which "auto" is resolved to by FetchMetrics or Do:
+	// not cached until then, so that a later call gets the resolved account ID
+	if p.AccountID == accountIDAuto {
+		return p.buildGraphDefinition()
+	}
+	p.graphdefOnce.Do(func() {
+		p.graphdef = p.buildGraphDefinition()
+	})
+	return p.graphdef
+}
+
+// buildGraphDefinition computes GraphDefinition from the options
+func (p *DynamoDBPlugin) buildGraphDefinition() map[string]mp.Graphs {
+	labelPrefix := strings.Title(p.MetricKeyPrefix())
+	labelPrefix = strings.Replace(labelPrefix, "-", " ", -1)
+
+	var graphdef = map[string]mp.Graphs{
+		"ReadCapacity": {
+			Label: (labelPrefix + " Read Capacity Units"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ProvisionedReadCapacityUnits", Label: "Provisioned"},
+				{Name: "ProvisionedReadCapacityUnitsAverage", Label: "Provisioned (Average)"},
+				{Name: "ConsumedReadCapacityUnitsNormalized", Label: "Consumed"},
+				{Name: "ConsumedReadCapacityUnitsAverage", Label: "Consumed (Average per request)"},
+			},
+		},
+		"WriteCapacity": {
+			Label: (labelPrefix + " Write Capacity Units"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ProvisionedWriteCapacityUnits", Label: "Provisioned"},
+				{Name: "ProvisionedWriteCapacityUnitsAverage", Label: "Provisioned (Average)"},
+				{Name: "ConsumedWriteCapacityUnitsNormalized", Label: "Consumed"},
+				{Name: "ConsumedWriteCapacityUnitsAverage", Label: "Consumed (Average per request)"},
+			},
+		},
+		"TotalCapacity": {
+			Label: (labelPrefix + " Total Consumed Capacity Units"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ConsumedCapacityUnitsTotalNormalized", Label: "Read + Write"},
+			},
+		},
+		"ThrottledEvents": {
+			Label: (labelPrefix + " Throttle Events"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ReadThrottleEvents", Label: "Read", Stacked: true},
+				{Name: "WriteThrottleEvents", Label: "Write", Stacked: true},
+				{Name: "ReadThrottleEventsMaximum", Label: "Read (Max burst)"},
+			},
+		},
+		"ConditionalCheckFailedRequests": {
+			Label: (labelPrefix + " ConditionalCheckFailedRequests"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "ConditionalCheckFailedRequests", Label: "Counts"},
+			},
 		},
 		"ThrottledRequests": {
 			Label: (labelPrefix + " ThrottledRequests"),
@@ -337,6 +1559,13 @@ func (p DynamoDBPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "*", Label: "%1", Stacked: true},
 			},
 		},
+		"UserErrorRate": {
+			Label: (labelPrefix + " UserErrors per Request"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "UserErrorRate", Label: "UserErrors / (SuccessfulRequests + UserErrors)"},
+			},
+		},
 		"SuccessfulRequests": {
 			Label: (labelPrefix + " SuccessfulRequestLatency"),
 			Unit:  "integer",
@@ -344,6 +1573,13 @@ func (p DynamoDBPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "*", Label: "%1"},
 			},
 		},
+		"RequestRate": {
+			Label: (labelPrefix + " Requests per second"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Stacked: true},
+			},
+		},
 		"SuccessfulRequestLatency.#": {
 			Label: (labelPrefix + " SuccessfulRequestLatency"),
 			Unit:  "integer",
@@ -353,18 +1589,545 @@ func (p DynamoDBPlugin) GraphDefinition() map[string]mp.Graphs {
 				{Name: "Average", Label: "Average"},
 			},
 		},
+		"PluginInternal": {
+			Label: (labelPrefix + " Plugin Internal"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "PluginRunDurationSeconds", Label: "Run Duration (seconds)"},
+				{Name: "MetricLagSeconds", Label: "Metric Lag (seconds)"},
+			},
+		},
+		"PluginInternal.BuildInfo": {
+			Label: (labelPrefix + " Plugin Version"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		},
+		"PluginInternal.Datapoints": {
+			Label: (labelPrefix + " Plugin Internal Datapoints"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		},
+	}
+
+	// ThrottledEvents.#, ReadCapacity.# and WriteCapacity.#
+	for key, graph := range IndexGraphs(indexMetricKeys(), labelPrefix) {
+		graphdef[key] = graph
+	}
+
+	if p.EmitPeriod {
+		graphdef["PluginInternal.Period"] = mp.Graphs{
+			Label: (labelPrefix + " Plugin Internal Period (seconds)"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		}
+	}
+
+	if p.NoProvisionedGraphLines {
+		// on-demand tables have no provisioned capacity
+		for _, key := range []string{"ReadCapacity", "WriteCapacity", "ReadCapacity.#", "WriteCapacity.#"} {
+			graph := graphdef[key]
+			metrics := make([]mp.Metrics, 0, len(graph.Metrics))
+			for _, m := range graph.Metrics {
+				if !strings.HasPrefix(m.Name, "Provisioned") {
+					metrics = append(metrics, m)
+				}
+			}
+			graph.Metrics = metrics
+			graphdef[key] = graph
+		}
+	}
+
+	if len(p.customMetricsGroups) > 0 {
+		graphdef["Custom"] = mp.Graphs{
+			Label: (labelPrefix + " Custom Metrics"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		}
+	}
+
+	if p.Utilization {
+		graphdef["CapacityUtilization"] = mp.Graphs{
+			Label: (labelPrefix + " Capacity Utilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "ReadCapacityUtilization", Label: "Read"},
+				{Name: "WriteCapacityUtilization", Label: "Write"},
+			},
+		}
+	}
+
+	if p.AggregateAllTables {
+		graphdef["AllTablesCapacity"] = mp.Graphs{
+			Label: (labelPrefix + " Consumed Capacity Units of All Tables"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "AllTablesConsumedReadCapacityUnitsNormalized", Label: "Read"},
+				{Name: "AllTablesConsumedWriteCapacityUnitsNormalized", Label: "Write"},
+			},
+		}
+	}
+
+	if p.Stream {
+		graphdef["StreamReplicationAge"] = mp.Graphs{
+			Label: (labelPrefix + " Age of Oldest Unreplicated Record"),
+			Unit:  "milliseconds",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1"},
+			},
+		}
+		graphdef["StreamReplicationFailures"] = mp.Graphs{
+			Label: (labelPrefix + " Failed to Replicate Records"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Stacked: true},
+			},
+		}
+		graphdef["CDC"] = mp.Graphs{
+			Label: (labelPrefix + " Consumed Change Data Capture Units"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Stacked: true},
+			},
+		}
+		graphdef["StreamThrottledPutRecords"] = mp.Graphs{
+			Label: (labelPrefix + " Records Throttled by the Stream"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Stacked: true},
+			},
+		}
+	}
+
+	if p.Replication || p.GlobalTable {
+		graphdef["ReplicationLatency.#"] = mp.Graphs{
+			Label: (labelPrefix + " Replication Latency"),
+			Unit:  "milliseconds",
+			Metrics: []mp.Metrics{
+				{Name: "Minimum", Label: "Min"},
+				{Name: "Maximum", Label: "Max"},
+				{Name: "Average", Label: "Average"},
+			},
+		}
+	}
+
+	if p.GlobalTable {
+		graphdef["PendingReplicationCount"] = mp.Graphs{
+			Label: (labelPrefix + " Pending Replication Count"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "*", Label: "%1", Stacked: true},
+			},
+		}
+		graphdef["ReplicaReadCapacity.#"] = mp.Graphs{
+			Label: (labelPrefix + " Read Capacity Units per Replica"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "Consumed", Label: "Consumed"},
+			},
+		}
+		graphdef["ReplicaWriteCapacity.#"] = mp.Graphs{
+			Label: (labelPrefix + " Write Capacity Units per Replica"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "Consumed", Label: "Consumed"},
+			},
+		}
+	}
+
+	if p.Trend {
+		graphdef["CapacityTrend"] = mp.Graphs{
+			Label: (labelPrefix + " Consumed Capacity Units (hourly)"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "ConsumedReadCapacityUnitsHourlyNormalized", Label: "Read"},
+				{Name: "ConsumedWriteCapacityUnitsHourlyNormalized", Label: "Write"},
+			},
+		}
+	}
+
+	if p.ReadConsistencyFactor > 0 {
+		graphdef["ReadThroughput"] = mp.Graphs{
+			Label: (labelPrefix + " Estimated Read Throughput"),
+			Unit:  "bytes/sec",
+			Metrics: []mp.Metrics{
+				{Name: "EstimatedReadBytesPerSecond", Label: "Read"},
+			},
+		}
+	}
+
+	if p.BillingMode {
+		graphdef["BillingMode"] = mp.Graphs{
+			Label: (labelPrefix + " Billing Mode"),
+			Unit:  "integer",
+			Metrics: []mp.Metrics{
+				{Name: "BillingModePayPerRequest", Label: "On-demand (1) or Provisioned (0)"},
+			},
+		}
+	}
+
+	if p.AccountMetrics {
+		graphdef[p.accountKey("TableLevelQuotas")] = mp.Graphs{
+			Label: (labelPrefix + " Table Level Quotas"),
+			Unit:  "float",
+			Metrics: []mp.Metrics{
+				{Name: "AccountMaxTableLevelReads", Label: "Max Reads"},
+				{Name: "AccountMaxTableLevelWrites", Label: "Max Writes"},
+			},
+		}
+		graphdef[p.accountKey("AccountCapacityUtilization")] = mp.Graphs{
+			Label: (labelPrefix + " Account Provisioned Capacity Utilization"),
+			Unit:  "percentage",
+			Metrics: []mp.Metrics{
+				{Name: "AccountProvisionedReadCapacityUtilizationAverage", Label: "Read"},
+				{Name: "AccountProvisionedReadCapacityUtilizationMaximum", Label: "Read (peak)"},
+				{Name: "AccountProvisionedWriteCapacityUtilizationAverage", Label: "Write"},
+				{Name: "AccountProvisionedWriteCapacityUtilizationMaximum", Label: "Write (peak)"},
+			},
+		}
+	}
+
+	if p.AveragePerSecond {
+		for _, key := range []string{"ReadCapacity", "WriteCapacity"} {
+			graph := graphdef[key]
+			name := "Consumed" + strings.TrimSuffix(key, "Capacity") + "CapacityUnitsAveragePerSecond"
+			graph.Metrics = append(graph.Metrics, mp.Metrics{Name: name, Label: "Consumed (Average per request / 60s)"})
+			graphdef[key] = graph
+		}
+	}
+
+	if p.LatencySeconds {
+		for _, key := range latencyGraphs {
+			graph, ok := graphdef[key]
+			if !ok {
+				continue
+			}
+			graph.Label += " (seconds)"
+			graph.Unit = "float"
+			graphdef[key] = graph
+		}
+	}
+
+	for key, unit := range p.Units {
+		graph, ok := graphdef[key]
+		if !ok {
+			log.Printf("Unknown graph for -unit, skip: %s", key)
+			continue
+		}
+		graph.Unit = unit
+		graphdef[key] = graph
+	}
+
+	if p.CloudWatchNames {
+		names := cloudWatchStyleNames()
+		for key, graph := range graphdef {
+			metrics := make([]mp.Metrics, len(graph.Metrics))
+			for i, m := range graph.Metrics {
+				if cwName, ok := names[m.Name]; ok {
+					m.Name = cwName
+				}
+				metrics[i] = m
+			}
+			graph.Metrics = metrics
+			graphdef[key] = graph
+		}
+	}
+
+	if p.Unstacked {
+		for key, graph := range graphdef {
+			metrics := make([]mp.Metrics, len(graph.Metrics))
+			for i, m := range graph.Metrics {
+				m.Stacked = false
+				metrics[i] = m
+			}
+			graph.Metrics = metrics
+			graphdef[key] = graph
+		}
 	}
 	return graphdef
 }
 
+// indexGraph is the label (after the prefix), unit and lines of a per-index graph known to the plugin
+type indexGraph struct {
+	label string
+	unit  string
+	lines []mp.Metrics
+}
+
+// per-index graphs of indexMetricsGroup, drawn by IndexGraphs
+var indexGraphs = map[string]indexGraph{
+	"ThrottledEvents": {"Throttle Events", "integer", []mp.Metrics{
+		{Name: "Read", Label: "Read", Stacked: true},
+		{Name: "Write", Label: "Write", Stacked: true},
+	}},
+	"ReadCapacity": {"Read Capacity Units", "float", []mp.Metrics{
+		{Name: "Provisioned", Label: "Provisioned"},
+		{Name: "Consumed", Label: "Consumed"},
+	}},
+	"WriteCapacity": {"Write Capacity Units", "float", []mp.Metrics{
+		{Name: "Provisioned", Label: "Provisioned"},
+		{Name: "Consumed", Label: "Consumed"},
+	}},
+}
+
+// indexMetricKeys returns a metric key of each line of the per-index graphs, as reported for an index
+func indexMetricKeys() []string {
+	var keys []string
+	for _, mg := range indexMetricsGroup {
+		for _, m := range mg.Metrics {
+			// the consumed capacity is drawn normalized per second (see transformMetrics)
+			keys = append(keys, strings.Replace(strings.TrimSuffix(m.MackerelName, "Sum"), "#", "index", 1))
+		}
+	}
+	return keys
+}
+
+// IndexGraphs builds wildcard graph definitions for metric keys of the form "<graph>.<index>.<metric>",
+// e.g. "ReadCapacity.my-index.Consumed" gives the graph "ReadCapacity.#" with the line "Consumed", so that each index gets its own graph.
+// The graphs of the plugin (ThrottledEvents, ReadCapacity and WriteCapacity) keep their label, unit and stacking,
+// so per-index metrics collected by other means than the plugin can share them; keys of another form are ignored
+func IndexGraphs(keys []string, labelPrefix string) map[string]mp.Graphs {
+	lines := make(map[string]map[string]bool)
+	for _, key := range keys {
+		parts := strings.Split(key, ".")
+		if len(parts) != 3 || parts[0] == "" || parts[1] == "" || parts[2] == "" {
+			continue
+		}
+		if lines[parts[0]] == nil {
+			lines[parts[0]] = make(map[string]bool)
+		}
+		lines[parts[0]][parts[2]] = true
+	}
+
+	graphdef := make(map[string]mp.Graphs, len(lines))
+	for graph, names := range lines {
+		known, ok := indexGraphs[graph]
+		if !ok {
+			known = indexGraph{label: graph, unit: "float"}
+		}
+		// the known lines in their order, then the others sorted
+		var metrics []mp.Metrics
+		for _, m := range known.lines {
+			if names[m.Name] {
+				metrics = append(metrics, m)
+				delete(names, m.Name)
+			}
+		}
+		others := make([]string, 0, len(names))
+		for name := range names {
+			others = append(others, name)
+		}
+		sort.Strings(others)
+		for _, name := range others {
+			metrics = append(metrics, mp.Metrics{Name: name, Label: name})
+		}
+		graphdef[graph+".#"] = mp.Graphs{
+			Label:   labelPrefix + " " + known.label + " per Index",
+			Unit:    known.unit,
+			Metrics: metrics,
+		}
+	}
+	return graphdef
+}
+
+// units allowed for Mackerel graphs
+var graphUnits = []string{"float", "integer", "percentage", "seconds", "milliseconds", "bytes", "bytes/sec", "bits/sec", "iops"}
+
+// unitFlag is a repeatable flag of "graph=unit" overriding the unit of graphs
+type unitFlag map[string]string
+
+func (u unitFlag) String() string {
+	pairs := make([]string, 0, len(u))
+	for graph, unit := range u {
+		pairs = append(pairs, graph+"="+unit)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, ",")
+}
+
+func (u unitFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected graph=unit: %s", value)
+	}
+	for _, unit := range graphUnits {
+		if kv[1] == unit {
+			u[kv[0]] = unit
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown unit %s, must be one of %s", kv[1], strings.Join(graphUnits, ", "))
+}
+
+// dimensionFlag is a repeatable flag of "name=value" adding dimensions to the queries
+type dimensionFlag []*cloudwatch.Dimension
+
+func (d *dimensionFlag) String() string {
+	pairs := make([]string, len(*d))
+	for i, dimension := range *d {
+		pairs[i] = aws.StringValue(dimension.Name) + "=" + aws.StringValue(dimension.Value)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (d *dimensionFlag) Set(value string) error {
+	kv := strings.SplitN(value, "=", 2)
+	if len(kv) != 2 || kv[0] == "" {
+		return fmt.Errorf("expected name=value: %s", value)
+	}
+	*d = append(*d, &cloudwatch.Dimension{
+		Name:  aws.String(kv[0]),
+		Value: aws.String(kv[1]),
+	})
+	return nil
+}
+
+// discover prints the CloudWatch metrics and dimension combinations available for the table
+func (p *DynamoDBPlugin) discover(w io.Writer) error {
+	input := &cloudwatch.ListMetricsInput{
+		Dimensions: []*cloudwatch.DimensionFilter{{
+			Name:  aws.String("TableName"),
+			Value: aws.String(p.TableName),
+		}},
+		Namespace: aws.String(namespace),
+	}
+	cwMetrics, err := p.listMetrics(context.Background(), input)
+	if err != nil {
+		return err
+	}
+
+	lines := make([]string, 0, len(cwMetrics))
+	for _, cwMetric := range cwMetrics {
+		dimensions := make([]string, len(cwMetric.Dimensions))
+		for i, d := range cwMetric.Dimensions {
+			dimensions[i] = aws.StringValue(d.Name) + "=" + aws.StringValue(d.Value)
+		}
+		sort.Strings(dimensions)
+		lines = append(lines, aws.StringValue(cwMetric.MetricName)+"\t"+strings.Join(dimensions, ", "))
+	}
+	sort.Strings(lines)
+
+	for _, line := range lines {
+		fmt.Fprintln(w, line)
+	}
+	return nil
+}
+
+// validateMetrics warns about the collected metrics which CloudWatch doesn't list for the table, e.g. misspelled or renamed ones.
+// Note that metrics without datapoints in the last two weeks aren't listed either, such as the throttle events of a table never throttled
+func (p *DynamoDBPlugin) validateMetrics() error {
+	input := &cloudwatch.ListMetricsInput{
+		Dimensions: []*cloudwatch.DimensionFilter{{
+			Name:  aws.String("TableName"),
+			Value: aws.String(p.TableName),
+		}},
+		Namespace: aws.String(namespace),
+	}
+	cwMetrics, err := p.listMetrics(context.Background(), input)
+	if err != nil {
+		return err
+	}
+	listed := make(map[string]bool, len(cwMetrics))
+	for _, cwMetric := range cwMetrics {
+		listed[aws.StringValue(cwMetric.MetricName)] = true
+	}
+
+	var names []string
+	for _, met := range defaultMetricsGroup {
+		if p.collects(met) {
+			names = append(names, met.CloudWatchName)
+		}
+	}
+	for _, met := range p.customMetricsGroups {
+		names = append(names, met.CloudWatchName)
+	}
+	for _, name := range names {
+		if !listed[name] {
+			log.Printf("%s is not listed by CloudWatch for the table %s, check the metric name", name, p.TableName)
+			// warn only once
+			listed[name] = true
+		}
+	}
+	return nil
+}
+
 // Do the plugin
 func Do() {
 	optAccessKeyID := flag.String("access-key-id", "", "AWS Access Key ID")
 	optSecretAccessKey := flag.String("secret-access-key", "", "AWS Secret Access Key")
 	optRegion := flag.String("region", "", "AWS Region")
+	optEndpoint := flag.String("endpoint", "", "CloudWatch endpoint URL used instead of the one of the region (e.g. an egress proxy), still signing the requests for the region")
+	optSigningRegion := flag.String("signing-region", "", "Region to sign the CloudWatch requests for, when it differs from -region (e.g. with -endpoint)")
+	optFIPS := flag.Bool("fips", false, "Use the FIPS endpoints of the AWS APIs, failing for the regions without the one of CloudWatch")
+	optRoleARN := flag.String("role-arn", "", "IAM Role ARN to assume, using the access keys (or the default credentials) as the base credentials")
+	optAWSConfigFile := flag.String("aws-config-file", "", "AWS shared config file used instead of the default location")
+	optAccountID := flag.String("account-id", "", "AWS Account ID appended to the metric key prefix, or \"auto\" to detect it with sts:GetCallerIdentity")
+	optOwningAccount := flag.String("owning-account", "", "Source account ID of the metrics queried with GetMetricData by -utilization, for CloudWatch cross-account observability (not with -aggregate-all-tables)")
+	optRetryBaseDelay := flag.Duration("retry-base-delay", 0, "Base delay of the jittered backoff on CloudWatch retries (default: SDK default)")
+	optRetryMaxDelay := flag.Duration("retry-max-delay", 0, "Max delay of the jittered backoff on CloudWatch retries (default: SDK default)")
+	optMaxConsecutiveFailures := flag.Int("max-consecutive-failures", 0, "Give up the run after this many CloudWatch calls failed in a row by throttling, 5xx or network errors, e.g. during an outage (0: never)")
+	optTimeoutTotal := flag.Duration("timeout-total", 50*time.Second, "Deadline of the whole run, after which the remaining metrics are skipped and the collected ones are reported (0: none)")
+	optGroupTimeout := flag.Duration("group-timeout", 0, "Timeout of each GetMetricStatistics call, so that a slow metric doesn't use up -timeout-total (0: none)")
+	optRateLimit := flag.Float64("rate-limit", 0, "Limit the GetMetricStatistics calls of all the plugin processes sharing -rate-limit-file to this many per second (best-effort, 0: no limit)")
+	optRateLimitFile := flag.String("rate-limit-file", filepath.Join(os.TempDir(), "mackerel-plugin-aws-dynamodb.rate-limit"), "File shared by the processes for -rate-limit")
+	optSDKLogLevel := flag.String("sdk-log-level", "off", "Log the AWS SDK requests to stderr: off, debug, debug-with-signing, debug-with-http-body, debug-with-request-retries, debug-with-request-errors")
 	optTableName := flag.String("table-name", "", "DynamoDB Table Name")
+	optDimensionsFromARN := flag.String("dimensions-from-arn", "", "ARN of a global secondary index, setting the table name and the GlobalSecondaryIndexName dimension (and the region when -region is not given)")
+	optFixTableNameCase := flag.Bool("fix-table-name-case", false, "When CloudWatch has no metrics for -table-name, look up the table whose name differs only in case with dynamodb:ListTables and use it")
 	optTempfile := flag.String("tempfile", "", "Temp file name")
-	optPrefix := flag.String("metric-key-prefix", "dynamodb", "Metric key prefix")
+	optFormat := flag.String("format", formatMackerel, "Output format: mackerel, graphite, jsonl")
+	optOutputFile := flag.String("output-file", "", "Write the metrics to the file (atomically replaced) instead of stdout")
+	optSocket := flag.String("socket", "", "Write the metrics to the Unix domain socket instead of stdout (logged to stderr when the socket is unavailable)")
+	optLoop := flag.Duration("loop", 0, "Fetch and print the metrics repeatedly at this interval until interrupted, for debugging (default: run once)")
+	optPrecision := flag.Int("precision", 10, "Round the float values written by -format=graphite/jsonl to this many significant digits (0: all the digits)")
+	optTimestampOffset := flag.Duration("timestamp-offset", 0, "Shift the timestamps written by -format=graphite/jsonl (e.g. -30s), not the queried time window")
+	optPrefix := flag.String("metric-key-prefix", defaultPrefix, "Metric key prefix")
+	optUnstacked := flag.Bool("unstacked", false, "Draw all graph lines overlaid instead of stacking throttle and error graphs")
+	optUnits := unitFlag{}
+	flag.Var(optUnits, "unit", "Override the unit of a graph as graph=unit (e.g. ReadCapacity=iops), can be repeated")
+	optQuiet := flag.Bool("quiet", false, "Suppress routine log messages such as skipped metrics, while still logging errors")
+	optChangedOnly := flag.Bool("changed-only", false, "Report only the metrics whose value changed since the last run, recorded next to the tempfile")
+	optEmitPeriod := flag.Bool("emit-period", false, "Also report the period of the CloudWatch datapoints of each metric, as PluginInternal.Period.<metric>")
+	optVerbose := flag.Bool("verbose", false, "Log a summary of the collected, empty and errored metrics at the end of each run")
+	optReplay := flag.String("replay", "", "Directory of recorded CloudWatch responses (JSON) to use instead of calling AWS")
+	optVerifyPermissions := flag.Bool("verify-permissions", false, "Try the API calls needed with the given options, print which IAM actions are denied with a policy to grant them, and exit")
+	optDiscover := flag.Bool("discover", false, "List the CloudWatch metrics and dimensions available for the table, and exit")
+	optValidateMetrics := flag.Bool("validate-metrics", false, "Warn about the collected metrics which CloudWatch doesn't list for the table")
+	optMetricsFor := flag.String("metrics-for", "all", "Comma separated presets of the table metrics to collect: capacity, errors, latency, all")
+	var optDimensions dimensionFlag
+	flag.Var(&optDimensions, "dimension", "Add a dimension as name=value to the table metric queries (e.g. Operation=GetItem), can be repeated")
+	optOperations := flag.String("operations", "", "Comma separated operations to collect latency, requests and errors for (default: all)")
+	optCollectIntervalHint := flag.Duration("collect-interval-hint", 0, "How often the plugin is run (e.g. 5m), to query a time window wide enough for infrequent runs")
+	optSelect := flag.String("select", selectLatest, "How to reduce the datapoints in the queried window to the value: latest, max, avg, first (the oldest)")
+	optSkipLatest := flag.Bool("skip-latest", false, "Use the second-latest datapoint for Sum metrics, since the latest one may be partially aggregated")
+	optMinAge := flag.Duration("min-age", 0, "Ignore datapoints newer than this (e.g. 2m), as they are likely incomplete")
+	optCloudWatchNames := flag.Bool("cloudwatch-names", false, "Name the table metrics after the CloudWatch metric and statistic (e.g. ConsumedReadCapacityUnits_Sum)")
+	optStrict := flag.Bool("strict", false, "Fail when a required table metric (e.g. the consumed capacity) has no datapoint, rather than omitting it")
+	optAssertProvisioned := flag.Bool("assert-provisioned", false, "Fail when the provisioned capacity is reported but zero")
+	optNaNMetrics := flag.String("nan-metrics", "", "Comma separated metric names to be reported as NaN instead of being omitted when they have no value, with -format=graphite/jsonl")
+	optScale := flag.Float64("scale", 1.0, "Multiplier applied to the values of -scale-metrics (purely cosmetic, e.g. 3600 to show per hour totals)")
+	optScaleMetrics := flag.String("scale-metrics", "ConsumedReadCapacityUnitsNormalized,ConsumedWriteCapacityUnitsNormalized,ConsumedCapacityUnitsTotalNormalized", "Comma separated metric names to which -scale is applied")
+	optNormalizedOnly := flag.Bool("normalized-only", false, "Drop the raw consumed capacity sums, reporting only their normalized per-second values")
+	optAveragePerSecond := flag.Bool("average-per-second", false, "Also report the Average (per request) consumed capacity divided by the period, which is not a throughput unlike the default Consumed")
+	optLatencySeconds := flag.Bool("latency-seconds", false, "Report the latency in seconds instead of milliseconds")
+	optReadConsistencyFactor := flag.Float64("read-consistency-factor", 0, "Also estimate the read throughput in bytes from the consumed read capacity, as 4 KB per unit times this factor (1: strongly consistent, 2: eventually consistent, 0.5: transactional)")
+	optBillingMode := flag.Bool("billing-mode", false, "Also report whether the table is on-demand (1) or provisioned (0), with dynamodb:DescribeTable")
+	optUtilization := flag.Bool("utilization", false, "Also collect capacity utilization (consumed / provisioned) computed by CloudWatch metric math")
+	optAggregateAllTables := flag.Bool("aggregate-all-tables", false, "Also collect consumed capacity summed over all tables in the region")
+	optStream := flag.Bool("stream", false, "Also collect metrics of the Kinesis Data Streams destination")
+	optReplication := flag.Bool("replication", false, "Also collect the replication latency of the global table per receiving region")
+	optGlobalTable := flag.Bool("global-table", false, "Also collect the replication and consumed capacity metrics of every replica of the global table, listed with dynamodb:DescribeTable")
+	optTrend := flag.Bool("trend", false, "Also collect consumed capacity aggregated hourly, on a separate graph")
+	optAccountMetrics := flag.Bool("account-metrics", false, "Also collect account-wide metrics such as AccountMaxTableLevelReads")
+	optAccountSubPrefix := flag.Bool("account-sub-prefix", false, "Put the -account-metrics under \"account.\" after the metric key prefix, apart from the table metrics")
+	optNoProvisionedGraphLines := flag.Bool("no-provisioned-graph-lines", false, "Remove the Provisioned lines from the capacity graphs, e.g. for on-demand tables")
 	flag.Parse()
 
 	var plugin DynamoDBPlugin
@@ -372,16 +2135,210 @@ func Do() {
 	plugin.AccessKeyID = *optAccessKeyID
 	plugin.SecretAccessKey = *optSecretAccessKey
 	plugin.Region = *optRegion
+	plugin.RoleARN = *optRoleARN
+	plugin.Endpoint = *optEndpoint
+	plugin.SigningRegion = *optSigningRegion
+	plugin.FIPS = *optFIPS
+	plugin.AWSConfigFile = *optAWSConfigFile
+	plugin.AccountID = *optAccountID
+	plugin.OwningAccount = *optOwningAccount
+	plugin.RetryBaseDelay = *optRetryBaseDelay
+	plugin.RetryMaxDelay = *optRetryMaxDelay
+	sdkLogLevel, ok := sdkLogLevels[*optSDKLogLevel]
+	if !ok {
+		log.Fatalf("unknown -sdk-log-level: %s", *optSDKLogLevel)
+	}
+	plugin.SDKLogLevel = sdkLogLevel
+	plugin.MaxConsecutiveFailures = *optMaxConsecutiveFailures
+	plugin.TotalTimeout = *optTimeoutTotal
+	plugin.GroupTimeout = *optGroupTimeout
 	plugin.TableName = *optTableName
 	plugin.Prefix = *optPrefix
-
-	err := plugin.prepare()
+	plugin.TimestampOffset = *optTimestampOffset
+	if *optPrecision < 0 {
+		log.Fatalf("-precision must not be negative: %d", *optPrecision)
+	}
+	plugin.Precision = *optPrecision
+	plugin.Quiet = *optQuiet
+	plugin.Verbose = *optVerbose
+	plugin.EmitPeriod = *optEmitPeriod
+	metricsFor, err := resolveMetricsPresets(strings.Split(*optMetricsFor, ","))
+	if err != nil {
+		log.Fatalln(err)
+	}
+	plugin.MetricsFor = metricsFor
+	operations, err := resolveOperations(strings.Split(*optOperations, ","))
 	if err != nil {
 		log.Fatalln(err)
 	}
+	plugin.Operations = operations
+	plugin.Dimensions = optDimensions
+	if *optDimensionsFromARN != "" {
+		index, err := parseIndexARN(*optDimensionsFromARN)
+		if err != nil {
+			log.Fatalln(err)
+		}
+		plugin.TableName = index.TableName
+		if plugin.Region == "" {
+			plugin.Region = index.Region
+		}
+		plugin.Dimensions = append(plugin.Dimensions, &cloudwatch.Dimension{
+			Name:  aws.String("GlobalSecondaryIndexName"),
+			Value: aws.String(index.IndexName),
+		})
+	}
+	plugin.CollectInterval = *optCollectIntervalHint
+	switch *optSelect {
+	case selectLatest, selectMax, selectAvg, selectFirst:
+		plugin.Select = *optSelect
+	default:
+		log.Fatalf("unknown -select: %s", *optSelect)
+	}
+	plugin.SkipLatest = *optSkipLatest
+	plugin.MinAge = *optMinAge
+	if *optNaNMetrics != "" {
+		// go-mackerel-plugin-helper drops NaN values with a log line, so only the graphite and jsonl outputs can show the marker
+		if *optFormat == formatMackerel {
+			log.Fatalln("-nan-metrics needs -format=graphite or -format=jsonl")
+		}
+		plugin.NaNMetrics = strings.Split(*optNaNMetrics, ",")
+	}
+	plugin.CloudWatchNames = *optCloudWatchNames
+	plugin.AssertProvisioned = *optAssertProvisioned
+	plugin.Strict = *optStrict
+	plugin.Scale = *optScale
+	if *optScaleMetrics != "" {
+		plugin.ScaleMetrics = strings.Split(*optScaleMetrics, ",")
+	}
+	plugin.NormalizedOnly = *optNormalizedOnly
+	plugin.AveragePerSecond = *optAveragePerSecond
+	plugin.LatencySeconds = *optLatencySeconds
+	plugin.ReadConsistencyFactor = *optReadConsistencyFactor
+	plugin.BillingMode = *optBillingMode
+	plugin.Utilization = *optUtilization
+	plugin.AggregateAllTables = *optAggregateAllTables
+	plugin.Stream = *optStream
+	plugin.Replication = *optReplication
+	plugin.GlobalTable = *optGlobalTable
+	plugin.Trend = *optTrend
+	plugin.AccountMetrics = *optAccountMetrics
+	plugin.AccountSubPrefix = *optAccountSubPrefix
+	plugin.NoProvisionedGraphLines = *optNoProvisionedGraphLines
+	plugin.Unstacked = *optUnstacked
+	plugin.Units = optUnits
+
+	if *optRateLimit > 0 {
+		plugin.rateLimiter = &rateLimiter{Path: *optRateLimitFile, Rate: *optRateLimit}
+	}
+	if *optReplay != "" {
+		plugin.CloudWatch = &replayCloudWatch{Dir: *optReplay}
+		plugin.DynamoDB = &replayDynamoDB{Dir: *optReplay}
+	} else if err := plugin.prepare(); err != nil {
+		log.Fatalln(err)
+	}
+	// for the graph definitions as well as the metrics
+	if err := plugin.resolveAccountID(context.Background()); err != nil {
+		log.Fatalln(err)
+	}
+
+	plugin.FixTableNameCase = *optFixTableNameCase
+	if plugin.FixTableNameCase {
+		if err := plugin.correctTableNameCase(context.Background()); err != nil {
+			log.Printf("Failed to look up the table name: %s", err)
+		}
+	}
+
+	if *optValidateMetrics {
+		if err := plugin.validateMetrics(); err != nil {
+			log.Printf("Failed to validate the metrics: %s", err)
+		}
+	}
+
+	if *optVerifyPermissions {
+		if err := plugin.verifyPermissions(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
 
-	helper := mp.NewMackerelPlugin(plugin)
-	helper.Tempfile = *optTempfile
+	if *optDiscover {
+		if err := plugin.discover(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+		return
+	}
+
+	if *optChangedOnly {
+		helper := mp.NewMackerelPlugin(&plugin)
+		helper.Tempfile = *optTempfile
+		plugin.LastValuesFile = helper.Tempfilename() + ".last-values"
+	}
 
-	helper.Run()
+	var output func(io.Writer) error
+	switch *optFormat {
+	case formatMackerel:
+		// the graph definitions for mackerel-agent, without fetching the metrics
+		if os.Getenv("MACKEREL_AGENT_PLUGIN_META") != "" {
+			helper := mp.NewMackerelPlugin(&plugin)
+			helper.OutputDefinitions()
+			return
+		}
+		output = plugin.outputMackerel
+	case formatGraphite:
+		output = plugin.outputGraphite
+	case formatJSONL:
+		output = plugin.outputJSONLines
+	default:
+		log.Fatalf("unknown -format: %s", *optFormat)
+	}
+
+	if *optOutputFile != "" && *optSocket != "" {
+		log.Fatalln("-output-file and -socket are mutually exclusive")
+	}
+	run := func() {
+		if err := output(os.Stdout); err != nil {
+			log.Fatalln(err)
+		}
+	}
+	if *optSocket != "" {
+		run = func() {
+			if err := writeToSocket(*optSocket, output, os.Stderr); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+	if *optOutputFile != "" {
+		run = func() {
+			if err := writeToFile(*optOutputFile, output); err != nil {
+				log.Fatalln(err)
+			}
+		}
+	}
+
+	if *optLoop > 0 {
+		ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+		defer stop()
+		runLoop(ctx, *optLoop, run)
+		return
+	}
+	run()
+}
+
+// runLoop calls run every interval until ctx is done, e.g. by SIGINT or SIGTERM, reusing the same plugin (and CloudWatch client).
+// A run in progress when ctx is done is completed, so that its output is never left partial
+func runLoop(ctx context.Context, interval time.Duration, run func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		run()
+		// a tick due at the same time mustn't start another run
+		if ctx.Err() != nil {
+			return
+		}
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
 }
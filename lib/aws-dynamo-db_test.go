@@ -0,0 +1,992 @@
+package mpawsdynamodb
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/credentials/stscreds"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/sts"
+	"github.com/aws/aws-sdk-go/service/sts/stsiface"
+	mp "github.com/mackerelio/go-mackerel-plugin-helper"
+)
+
+// fakeCloudWatch answers CloudWatch API calls from memory, keyed like the fixtures of replayCloudWatch:
+// <MetricName>, or <MetricName>.<dimension value> for dimensions other than TableName
+type fakeCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+
+	datapoints map[string][]*cloudwatch.Datapoint
+	// metrics returned by ListMetrics, by metric name
+	metrics map[string][]*cloudwatch.Metric
+	// metrics per ListMetrics page, or 0 for a single page
+	pageSize int
+	// pages returned by GetMetricData in turn, following NextToken
+	metricData []*cloudwatch.GetMetricDataOutput
+
+	// errors injected into the calls for a metric name or key, "ListMetrics.<name>" or "GetMetricData", to exercise the error paths
+	errors map[string]error
+
+	// metric names of the GetMetricStatistics calls, in order
+	calls []string
+	// inputs of the GetMetricData calls, in order
+	metricDataInputs []*cloudwatch.GetMetricDataInput
+}
+
+func newFakeCloudWatch() *fakeCloudWatch {
+	return &fakeCloudWatch{
+		datapoints: make(map[string][]*cloudwatch.Datapoint),
+		metrics:    make(map[string][]*cloudwatch.Metric),
+		errors:     make(map[string]error),
+	}
+}
+
+// fakeKey returns the key of the metric with the dimensions in fakeCloudWatch
+func fakeKey(name string, dimensions []*cloudwatch.Dimension) string {
+	parts := []string{name}
+	for _, d := range dimensions {
+		if aws.StringValue(d.Name) != "TableName" {
+			parts = append(parts, aws.StringValue(d.Value))
+		}
+	}
+	return strings.Join(parts, ".")
+}
+
+// add registers datapoints of the metric of the table, with an extra dimension if dimensionName is not empty
+func (f *fakeCloudWatch) add(name, dimensionName, dimensionValue string, dps ...*cloudwatch.Datapoint) {
+	dimensions := []*cloudwatch.Dimension{{Name: aws.String("TableName"), Value: aws.String(testTable)}}
+	if dimensionName != "" {
+		dimensions = append(dimensions, &cloudwatch.Dimension{Name: aws.String(dimensionName), Value: aws.String(dimensionValue)})
+	}
+	f.metrics[name] = append(f.metrics[name], &cloudwatch.Metric{
+		Namespace:  aws.String(namespace),
+		MetricName: aws.String(name),
+		Dimensions: dimensions,
+	})
+	key := fakeKey(name, dimensions)
+	f.datapoints[key] = append(f.datapoints[key], dps...)
+}
+
+// count returns the number of GetMetricStatistics calls for the metric name
+func (f *fakeCloudWatch) count(name string) int {
+	n := 0
+	for _, call := range f.calls {
+		if call == name {
+			n++
+		}
+	}
+	return n
+}
+
+func (f *fakeCloudWatch) GetMetricStatisticsWithContext(ctx aws.Context, input *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	name := aws.StringValue(input.MetricName)
+	f.calls = append(f.calls, name)
+	if err := ctx.Err(); err != nil {
+		return nil, awserr.New(request.CanceledErrorCode, "request context canceled", err)
+	}
+	key := fakeKey(name, input.Dimensions)
+	for _, k := range []string{name, key} {
+		if err, ok := f.errors[k]; ok {
+			return nil, err
+		}
+	}
+	var dps []*cloudwatch.Datapoint
+	for _, dp := range f.datapoints[key] {
+		// EndTime is exclusive
+		if !dp.Timestamp.Before(*input.StartTime) && dp.Timestamp.Before(*input.EndTime) {
+			dps = append(dps, dp)
+		}
+	}
+	return &cloudwatch.GetMetricStatisticsOutput{Datapoints: dps}, nil
+}
+
+func (f *fakeCloudWatch) ListMetricsWithContext(ctx aws.Context, input *cloudwatch.ListMetricsInput, opts ...request.Option) (*cloudwatch.ListMetricsOutput, error) {
+	name := aws.StringValue(input.MetricName)
+	if err, ok := f.errors["ListMetrics."+name]; ok {
+		return nil, err
+	}
+	metrics := f.metrics[name]
+	if input.MetricName == nil {
+		// all the metrics, in a stable order for the pages
+		names := make([]string, 0, len(f.metrics))
+		for n := range f.metrics {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		for _, n := range names {
+			metrics = append(metrics, f.metrics[n]...)
+		}
+	}
+	start := 0
+	if input.NextToken != nil {
+		start, _ = strconv.Atoi(*input.NextToken)
+	}
+	output := &cloudwatch.ListMetricsOutput{Metrics: metrics[start:]}
+	if f.pageSize > 0 && len(metrics)-start > f.pageSize {
+		output.Metrics = metrics[start : start+f.pageSize]
+		output.NextToken = aws.String(strconv.Itoa(start + f.pageSize))
+	}
+	return output, nil
+}
+
+func (f *fakeCloudWatch) GetMetricDataWithContext(ctx aws.Context, input *cloudwatch.GetMetricDataInput, opts ...request.Option) (*cloudwatch.GetMetricDataOutput, error) {
+	f.metricDataInputs = append(f.metricDataInputs, input)
+	if err, ok := f.errors["GetMetricData"]; ok {
+		return nil, err
+	}
+	page := 0
+	if input.NextToken != nil {
+		page, _ = strconv.Atoi(*input.NextToken)
+	}
+	if page >= len(f.metricData) {
+		return &cloudwatch.GetMetricDataOutput{}, nil
+	}
+	return f.metricData[page], nil
+}
+
+const testTable = "test-table"
+
+// testNow is the clock of the test plugins
+var testNow = time.Date(2020, 1, 2, 3, 4, 0, 0, time.UTC)
+
+// datapoint returns a datapoint ago before testNow with all the statistics set to v
+func datapoint(ago time.Duration, v float64) *cloudwatch.Datapoint {
+	return &cloudwatch.Datapoint{
+		Timestamp:   aws.Time(testNow.Add(-ago)),
+		Average:     aws.Float64(v),
+		Sum:         aws.Float64(v),
+		Maximum:     aws.Float64(v),
+		Minimum:     aws.Float64(v),
+		SampleCount: aws.Float64(v),
+	}
+}
+
+func newTestPlugin(cw cloudwatchiface.CloudWatchAPI) *DynamoDBPlugin {
+	return &DynamoDBPlugin{
+		TableName:  testTable,
+		CloudWatch: cw,
+		Quiet:      true,
+		now:        func() time.Time { return testNow },
+	}
+}
+
+var errThrottled = awserr.NewRequestFailure(awserr.New("Throttling", "Rate exceeded", nil), 400, "")
+
+func TestFetchMetricsInjectedErrorSkipsOnlyTheGroup(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 120))
+	cw.add("ConsumedWriteCapacityUnits", "", "", datapoint(2*time.Minute, 60))
+	cw.errors["ConsumedWriteCapacityUnits"] = errThrottled
+
+	stats, err := newTestPlugin(cw).FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["ConsumedReadCapacityUnitsSum"] != 120.0 {
+		t.Errorf("ConsumedReadCapacityUnitsSum = %v, want 120", stats["ConsumedReadCapacityUnitsSum"])
+	}
+	if _, ok := stats["ConsumedWriteCapacityUnitsSum"]; ok {
+		t.Errorf("ConsumedWriteCapacityUnitsSum is reported for the failed call")
+	}
+}
+
+func TestFetchMetricsInjectedErrorFailsStrict(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 120))
+	cw.add("ConsumedWriteCapacityUnits", "", "", datapoint(2*time.Minute, 60))
+	cw.errors["ConsumedWriteCapacityUnits"] = errThrottled
+	p := newTestPlugin(cw)
+	p.MetricsFor = map[string]bool{"ConsumedReadCapacityUnits": true, "ConsumedWriteCapacityUnits": true}
+	p.Strict = true
+
+	_, err := p.FetchMetrics()
+	if err == nil || !strings.Contains(err.Error(), "ConsumedWriteCapacityUnitsSum") {
+		t.Errorf("FetchMetrics error = %v, want the missing ConsumedWriteCapacityUnitsSum", err)
+	}
+}
+
+func TestFetchMetricsGivesUpAfterConsecutiveFailures(t *testing.T) {
+	cw := newFakeCloudWatch()
+	for _, mg := range defaultMetricsGroup {
+		cw.errors[mg.CloudWatchName] = errThrottled
+	}
+	p := newTestPlugin(cw)
+	p.MaxConsecutiveFailures = 3
+
+	if _, err := p.FetchMetrics(); err == nil || !strings.Contains(err.Error(), "giving up after 3") {
+		t.Errorf("FetchMetrics error = %v, want giving up after 3 failures", err)
+	}
+	if n := len(cw.calls); n != 3 {
+		t.Errorf("%d calls, want 3 before giving up", n)
+	}
+}
+
+func TestFetchMetricsAccessDeniedDoesNotGiveUp(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 120))
+	denied := awserr.NewRequestFailure(awserr.New("AccessDenied", "not authorized to perform: cloudwatch:ListMetrics", nil), 403, "")
+	for _, mg := range indexMetricsGroup {
+		cw.errors["ListMetrics."+mg.CloudWatchName] = denied
+	}
+	for _, mg := range operationalMetricsGroup {
+		cw.errors["ListMetrics."+mg.CloudWatchName] = denied
+	}
+	p := newTestPlugin(cw)
+	p.MaxConsecutiveFailures = 3
+
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["ConsumedReadCapacityUnitsSum"] != 120.0 {
+		t.Errorf("ConsumedReadCapacityUnitsSum = %v, want 120", stats["ConsumedReadCapacityUnitsSum"])
+	}
+}
+
+func TestIsTransientError(t *testing.T) {
+	cases := []struct {
+		err  error
+		want bool
+	}{
+		{errThrottled, true},
+		{awserr.NewRequestFailure(awserr.New("InternalFailure", "", nil), 500, ""), true},
+		{awserr.New("RequestError", "send request failed", nil), true},
+		{awserr.NewRequestFailure(awserr.New("AccessDenied", "", nil), 403, ""), false},
+		{awserr.NewRequestFailure(awserr.New("InvalidParameterValue", "", nil), 400, ""), false},
+	}
+	for _, c := range cases {
+		if got := isTransientError(c.err); got != c.want {
+			t.Errorf("isTransientError(%v) = %v, want %v", c.err, got, c.want)
+		}
+	}
+}
+
+func TestFetchWildcardMetricsKeepsOtherValuesOnError(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("SuccessfulRequestLatency", "Operation", "GetItem", datapoint(2*time.Minute, 5))
+	cw.add("SuccessfulRequestLatency", "Operation", "Query", datapoint(2*time.Minute, 8))
+	cw.errors["SuccessfulRequestLatency.GetItem"] = errThrottled
+	p := newTestPlugin(cw)
+
+	run := &fetchRun{ctx: context.Background()}
+	stats := make(map[string]interface{})
+
+	if err := p.fetchWildcardMetrics(run, operationalMetricsGroup[0], p.tableDimensions(), "Operation", stats); err != nil {
+		t.Fatalf("fetchWildcardMetrics: %s", err)
+	}
+	if run.breaker.total != 1 {
+		t.Errorf("%d errors recorded, want 1 for the failed GetItem", run.breaker.total)
+	}
+	if stats["SuccessfulRequestLatency.Query.Average"] != 8.0 {
+		t.Errorf("SuccessfulRequestLatency.Query.Average = %v, want 8", stats["SuccessfulRequestLatency.Query.Average"])
+	}
+}
+
+func TestResolveOperations(t *testing.T) {
+	all, err := resolveOperations([]string{""})
+	if err != nil || all != nil {
+		t.Errorf("resolveOperations(\"\") = %v, %v, want nil to collect all", all, err)
+	}
+	ops, err := resolveOperations([]string{"GetItem", "TransactWriteItems"})
+	if err != nil || len(ops) != 2 || !ops["TransactWriteItems"] {
+		t.Errorf("resolveOperations = %v, %v, want GetItem and TransactWriteItems", ops, err)
+	}
+	if _, err := resolveOperations([]string{"GetItems"}); err == nil {
+		t.Errorf("no error for an unknown operation")
+	}
+}
+
+func TestFetchMetricsCollectsAllOperationsByDefault(t *testing.T) {
+	cw := newFakeCloudWatch()
+	for _, op := range []string{"GetItem", "TransactWriteItems", "ExecuteStatement", "GetRecords"} {
+		cw.add("SuccessfulRequestLatency", "Operation", op, datapoint(2*time.Minute, 4))
+	}
+
+	stats, err := newTestPlugin(cw).FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	for _, op := range []string{"GetItem", "TransactWriteItems", "ExecuteStatement", "GetRecords"} {
+		if _, ok := stats["SuccessfulRequests."+op]; !ok {
+			t.Errorf("SuccessfulRequests.%s is not reported", op)
+		}
+	}
+}
+
+func TestResetRecreatesClientsFromSession(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("eu-west-1"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+	p := NewDynamoDBPluginWithSession(testTable, sess)
+	p.Region = "us-east-1"
+
+	for i := 0; i < 2; i++ {
+		if err := p.prepare(); err != nil {
+			t.Fatalf("prepare: %s", err)
+		}
+		cw, ok := p.CloudWatch.(*cloudwatch.CloudWatch)
+		if !ok {
+			t.Fatalf("CloudWatch is %T", p.CloudWatch)
+		}
+		if region := cw.ClientInfo.SigningRegion; region != "eu-west-1" {
+			t.Errorf("signing region %s, want eu-west-1 of the session rather than the Region option", region)
+		}
+		p.Reset()
+		if p.CloudWatch != nil {
+			t.Errorf("CloudWatch is kept by Reset")
+		}
+	}
+}
+
+func TestFetchMetricsCreatesClientOnce(t *testing.T) {
+	cw := newFakeCloudWatch()
+	p := newTestPlugin(cw)
+	for i := 0; i < 2; i++ {
+		if _, err := p.FetchMetrics(); err != nil {
+			t.Fatalf("FetchMetrics: %s", err)
+		}
+	}
+	if p.CloudWatch != cw {
+		t.Errorf("CloudWatch is replaced by FetchMetrics")
+	}
+}
+
+func TestAccountIDAuto(t *testing.T) {
+	fake := &fakeSTS{err: errThrottled}
+	p := newTestPlugin(newFakeCloudWatch())
+	p.AccountID = accountIDAuto
+	p.STS = fake
+
+	if label := p.GraphDefinition()["ReadCapacity"].Label; !strings.HasPrefix(label, "Dynamodb Auto") || fake.identityCalls != 0 {
+		t.Fatalf("label %q after %d GetCallerIdentity, want no call before the account ID is resolved", label, fake.identityCalls)
+	}
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Fatal("FetchMetrics succeeded without the account ID")
+	}
+	if label := p.GraphDefinition()["ReadCapacity"].Label; !strings.HasPrefix(label, "Dynamodb Auto") {
+		t.Fatalf("label %q after the failure", label)
+	}
+
+	fake.err = nil
+	fake.account = "123456789012"
+	for i := 0; i < 2; i++ {
+		if _, err := p.FetchMetrics(); err != nil {
+			t.Fatalf("FetchMetrics: %s", err)
+		}
+	}
+	if fake.identityCalls != 2 {
+		t.Errorf("%d GetCallerIdentity, want the account ID looked up until resolved", fake.identityCalls)
+	}
+	if label := p.GraphDefinition()["ReadCapacity"].Label; !strings.HasPrefix(label, "Dynamodb 123456789012") {
+		t.Errorf("label %q, want the resolved account ID", label)
+	}
+	if prefix := p.MetricKeyPrefix(); prefix != "dynamodb-123456789012" {
+		t.Errorf("MetricKeyPrefix() = %q, want the resolved account ID", prefix)
+	}
+}
+
+func TestIndexGraphs(t *testing.T) {
+	graphdef := IndexGraphs([]string{
+		"ThrottledEvents.idx.Write", "ThrottledEvents.idx.Read",
+		"ReadCapacity.idx.Consumed", "ReadCapacity.other.Provisioned",
+		"Latency.idx.P99", "Latency.idx.P50",
+		"ReadCapacity", "ReadCapacity.idx",
+	}, "Dynamodb")
+
+	throttled := graphdef["ThrottledEvents.#"]
+	if throttled.Label != "Dynamodb Throttle Events per Index" || throttled.Unit != "integer" {
+		t.Errorf("ThrottledEvents.# = %q in %s, want the graph of the plugin", throttled.Label, throttled.Unit)
+	}
+	for _, m := range throttled.Metrics {
+		if !m.Stacked {
+			t.Errorf("ThrottledEvents.# line %s is not stacked", m.Name)
+		}
+	}
+	if names := metricNames(graphdef["ReadCapacity.#"]); names != "Provisioned,Consumed" {
+		t.Errorf("ReadCapacity.# lines %s, want Provisioned,Consumed", names)
+	}
+	latency := graphdef["Latency.#"]
+	if names := metricNames(latency); latency.Unit != "float" || names != "P50,P99" {
+		t.Errorf("Latency.# lines %s in %s, want P50,P99 in float", names, latency.Unit)
+	}
+	if len(graphdef) != 3 {
+		t.Errorf("%d graphs, want 3 ignoring the keys of another form", len(graphdef))
+	}
+}
+
+func TestGraphDefinitionIndexGraphs(t *testing.T) {
+	graphdef := newTestPlugin(nil).GraphDefinition()
+	for key, want := range map[string]string{
+		"ThrottledEvents.#": "Read,Write",
+		"ReadCapacity.#":    "Provisioned,Consumed",
+		"WriteCapacity.#":   "Provisioned,Consumed",
+	} {
+		if names := metricNames(graphdef[key]); names != want {
+			t.Errorf("%s lines %s, want %s", key, names, want)
+		}
+	}
+}
+
+// metricNames returns the names of the lines of the graph
+func metricNames(graph mp.Graphs) string {
+	names := make([]string, len(graph.Metrics))
+	for i, m := range graph.Metrics {
+		names[i] = m.Name
+	}
+	return strings.Join(names, ",")
+}
+
+func TestRunLoopStopsWhenCanceled(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	runs := 0
+	done := make(chan struct{})
+	go func() {
+		runLoop(ctx, time.Millisecond, func() {
+			runs++
+			if runs == 3 {
+				// the signal arrives during a run, which is completed
+				cancel()
+			}
+		})
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("runLoop didn't return after the cancellation")
+	}
+	if runs != 3 {
+		t.Errorf("%d runs, want 3 stopping after the run in progress", runs)
+	}
+}
+
+func TestSanitizeMetricKey(t *testing.T) {
+	cases := map[string]string{
+		"ThrottledEvents.My_Index.Read": "ThrottledEvents.My_Index.Read",
+		"dynamodb-app.users":            "dynamodb-app.users",
+		"Custom.a b/c":                  "Custom.a_b_c",
+		"Custom.a  /b":                  "Custom.a_b",
+	}
+	for key, want := range cases {
+		if got := sanitizeMetricKey(key); got != want {
+			t.Errorf("sanitizeMetricKey(%q) = %q, want %q", key, got, want)
+		}
+	}
+	if got := sanitizeMetricKeyPart("app.users"); got != "app_users" {
+		t.Errorf("sanitizeMetricKeyPart(\"app.users\") = %q, want the dot replaced", got)
+	}
+}
+
+func TestFetchMetricsSanitizesIndexNames(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ReadThrottleEvents", "GlobalSecondaryIndexName", "By_UserID", datapoint(2*time.Minute, 1))
+	cw.add("ReadThrottleEvents", "GlobalSecondaryIndexName", "by.created at", datapoint(2*time.Minute, 2))
+	p := newTestPlugin(cw)
+	p.TableName = "app.users"
+
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	for key, want := range map[string]float64{
+		"ThrottledEvents.By_UserID.Read":     1,
+		"ThrottledEvents.by_created_at.Read": 2,
+	} {
+		if stats[key] != want {
+			t.Errorf("%s = %v, want %v", key, stats[key], want)
+		}
+	}
+	if prefix := (&DynamoDBPlugin{Prefix: "app.users table"}).MetricKeyPrefix(); prefix != "app.users_table" {
+		t.Errorf("MetricKeyPrefix() = %q, want the space replaced", prefix)
+	}
+}
+
+// fakeSTS issues assumed role credentials valid for a minute of clock, and tells the caller to be of account unless err is set
+type fakeSTS struct {
+	stsiface.STSAPI
+	clock func() time.Time
+	calls int
+
+	account       string
+	err           error
+	identityCalls int
+}
+
+func (f *fakeSTS) GetCallerIdentityWithContext(ctx aws.Context, input *sts.GetCallerIdentityInput, opts ...request.Option) (*sts.GetCallerIdentityOutput, error) {
+	f.identityCalls++
+	if f.err != nil {
+		return nil, f.err
+	}
+	return &sts.GetCallerIdentityOutput{Account: aws.String(f.account)}, nil
+}
+
+func (f *fakeSTS) AssumeRole(input *sts.AssumeRoleInput) (*sts.AssumeRoleOutput, error) {
+	f.calls++
+	return &sts.AssumeRoleOutput{Credentials: &sts.Credentials{
+		AccessKeyId:     aws.String(fmt.Sprintf("ASIA%d", f.calls)),
+		SecretAccessKey: aws.String("secret"),
+		SessionToken:    aws.String("token"),
+		Expiration:      aws.Time(f.clock().Add(time.Minute)),
+	}}, nil
+}
+
+func TestAssumedRoleCredentialsAreRefreshed(t *testing.T) {
+	now := testNow
+	clock := func() time.Time { return now }
+	fake := &fakeSTS{clock: clock}
+	p := &DynamoDBPlugin{
+		TableName:       testTable,
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		RoleARN:         "arn:aws:iam::123456789012:role/mackerel",
+		assumeRoleOptions: []func(*stscreds.AssumeRoleProvider){func(provider *stscreds.AssumeRoleProvider) {
+			provider.Client = fake
+			provider.Expiry.CurrentTime = clock
+		}},
+	}
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	creds := p.CloudWatch.(*cloudwatch.CloudWatch).Config.Credentials
+
+	value, err := creds.Get()
+	if err != nil || value.AccessKeyID != "ASIA1" || fake.calls != 1 {
+		t.Fatalf("credentials %s, %v after %d AssumeRole, want ASIA1 of the first", value.AccessKeyID, err, fake.calls)
+	}
+	now = now.Add(30 * time.Second)
+	if value, _ := creds.Get(); value.AccessKeyID != "ASIA1" || fake.calls != 1 {
+		t.Errorf("credentials %s after %d AssumeRole, want ASIA1 reused before the expiry", value.AccessKeyID, fake.calls)
+	}
+	now = now.Add(time.Minute)
+	if value, _ := creds.Get(); value.AccessKeyID != "ASIA2" || fake.calls != 2 {
+		t.Errorf("credentials %s after %d AssumeRole, want ASIA2 retrieved after the expiry", value.AccessKeyID, fake.calls)
+	}
+}
+
+func TestMetricKeyPrefixEmpty(t *testing.T) {
+	p := &DynamoDBPlugin{TableName: testTable}
+	for i := 0; i < 2; i++ {
+		if prefix := p.MetricKeyPrefix(); prefix != "dynamodb" {
+			t.Errorf("MetricKeyPrefix() = %q, want dynamodb for an empty Prefix", prefix)
+		}
+	}
+	if p.Prefix != "" {
+		t.Errorf("Prefix is changed to %q", p.Prefix)
+	}
+	p.AccountID = "123456789012"
+	if prefix := p.MetricKeyPrefix(); prefix != "dynamodb-123456789012" {
+		t.Errorf("MetricKeyPrefix() = %q, want dynamodb-123456789012", prefix)
+	}
+}
+
+func TestGraphDefinitionLabelsWithEmptyPrefix(t *testing.T) {
+	graphdef := (&DynamoDBPlugin{TableName: testTable}).GraphDefinition()
+	for key, graph := range graphdef {
+		if !strings.HasPrefix(graph.Label, "Dynamodb ") {
+			t.Errorf("label of %s is %q, want it prefixed with Dynamodb", key, graph.Label)
+		}
+	}
+	if label := graphdef["ReadCapacity"].Label; label != "Dynamodb Read Capacity Units" {
+		t.Errorf("label of ReadCapacity is %q", label)
+	}
+}
+
+func TestCloudWatchClientUsesProxyFromEnvironment(t *testing.T) {
+	p := &DynamoDBPlugin{
+		TableName:       testTable,
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+	}
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	// the SDK sends with http.DefaultClient unless a client is configured
+	httpClient := p.CloudWatch.(*cloudwatch.CloudWatch).Config.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+	transport := httpClient.Transport
+	if transport == nil {
+		transport = http.DefaultTransport
+	}
+	if tr, ok := transport.(*http.Transport); !ok || tr.Proxy == nil {
+		t.Errorf("transport %T has no Proxy func, HTTPS_PROXY and NO_PROXY would be ignored", transport)
+	}
+}
+
+func TestWithMetricGroups(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("OnlineIndexPercentageProgress", "", "", datapoint(2*time.Minute, 42))
+	p := newTestPlugin(cw).WithMetricGroups([]MetricsGroup{
+		{CloudWatchName: "OnlineIndexPercentageProgress", Metrics: []Metric{
+			{MackerelName: "OnlineIndexProgress", Type: metricsTypeMaximum},
+		}},
+	})
+
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["Custom.OnlineIndexProgress"] != 42.0 {
+		t.Errorf("Custom.OnlineIndexProgress = %v, want 42", stats["Custom.OnlineIndexProgress"])
+	}
+	if cw.count("ConsumedReadCapacityUnits") == 0 {
+		t.Errorf("the default groups are not fetched along with the custom one")
+	}
+	if _, ok := p.GraphDefinition()["Custom"]; !ok {
+		t.Errorf("no Custom graph")
+	}
+}
+
+// missingProvider finds no credentials, like the environment without the variables
+type missingProvider struct{}
+
+func (missingProvider) Retrieve() (credentials.Value, error) {
+	return credentials.Value{}, awserr.New("EnvAccessKeyNotFound", "AWS_ACCESS_KEY_ID or AWS_ACCESS_KEY not found in environment", nil)
+}
+
+func (missingProvider) IsExpired() bool { return true }
+
+func TestCheckCredentialsWithEmptyChain(t *testing.T) {
+	err := checkCredentials(credentials.NewChainCredentials([]credentials.Provider{missingProvider{}, missingProvider{}}))
+	if err == nil || !strings.Contains(err.Error(), "no AWS credentials found") {
+		t.Errorf("checkCredentials error = %v, want no AWS credentials found", err)
+	}
+	if err := checkCredentials(credentials.NewStaticCredentials("AKID", "SECRET", "")); err != nil {
+		t.Errorf("checkCredentials error = %v for static keys", err)
+	}
+}
+
+func TestSelectDatapointMinAge(t *testing.T) {
+	p := newTestPlugin(nil)
+	p.MinAge = 2 * time.Minute
+	cases := []struct {
+		name       string
+		datapoints []*cloudwatch.Datapoint
+		want       float64
+	}{
+		{"newer dropped", []*cloudwatch.Datapoint{datapoint(time.Minute, 1), datapoint(3*time.Minute, 3)}, 3},
+		{"just newer dropped", []*cloudwatch.Datapoint{datapoint(2*time.Minute-time.Second, 1), datapoint(3*time.Minute, 3)}, 3},
+		{"at the boundary kept", []*cloudwatch.Datapoint{datapoint(2*time.Minute, 2), datapoint(3*time.Minute, 3)}, 2},
+	}
+	for _, c := range cases {
+		dp := p.selectDatapoint(c.datapoints, metricsTypeSum)
+		if dp == nil || *dp.Sum != c.want {
+			t.Errorf("%s: selected %v, want %v", c.name, dp, c.want)
+		}
+	}
+	if dp := p.selectDatapoint([]*cloudwatch.Datapoint{datapoint(time.Minute, 1)}, metricsTypeSum); dp != nil {
+		t.Errorf("selected %v, want none when all the datapoints are newer than MinAge", dp)
+	}
+}
+
+func TestGraphDefinitionIsCached(t *testing.T) {
+	p := newTestPlugin(newFakeCloudWatch())
+	first := p.GraphDefinition()
+	second := p.GraphDefinition()
+	if reflect.ValueOf(first).Pointer() != reflect.ValueOf(second).Pointer() {
+		t.Errorf("GraphDefinition is built again on the second call")
+	}
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("GraphDefinition differs between the calls")
+	}
+	p.Reset()
+	if reflect.ValueOf(p.GraphDefinition()).Pointer() == reflect.ValueOf(first).Pointer() {
+		t.Errorf("GraphDefinition is still cached after Reset")
+	}
+}
+
+func TestAssertProvisioned(t *testing.T) {
+	cases := []struct {
+		name        string
+		provisioned []float64
+		wantErr     bool
+	}{
+		{"zero", []float64{0}, true},
+		{"provisioned", []float64{5}, false},
+		// on-demand tables have no provisioned capacity metrics
+		{"on-demand", nil, false},
+	}
+	for _, c := range cases {
+		cw := newFakeCloudWatch()
+		cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 60))
+		for _, v := range c.provisioned {
+			cw.add("ProvisionedReadCapacityUnits", "", "", datapoint(2*time.Minute, v))
+			cw.add("ProvisionedWriteCapacityUnits", "", "", datapoint(2*time.Minute, v))
+		}
+		p := newTestPlugin(cw)
+		p.AssertProvisioned = true
+
+		_, err := p.FetchMetrics()
+		if (err != nil) != c.wantErr {
+			t.Errorf("%s: FetchMetrics error = %v, want error %v", c.name, err, c.wantErr)
+		}
+	}
+}
+
+func TestStaticKeysAreBaseCredentialsOfRole(t *testing.T) {
+	var stsClient *sts.STS
+	p := &DynamoDBPlugin{
+		TableName:       testTable,
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		RoleARN:         "arn:aws:iam::123456789012:role/mackerel",
+		assumeRoleOptions: []func(*stscreds.AssumeRoleProvider){func(provider *stscreds.AssumeRoleProvider) {
+			stsClient, _ = provider.Client.(*sts.STS)
+			// sts:AssumeRole can't be reached in the tests
+			provider.Client = &fakeSTS{clock: time.Now}
+		}},
+	}
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	if stsClient == nil {
+		t.Fatal("no STS client for the role")
+	}
+	value, err := stsClient.Config.Credentials.Get()
+	if err != nil || value.AccessKeyID != "AKID" || value.SecretAccessKey != "SECRET" {
+		t.Errorf("STS client credentials %s, %v, want the static keys", value.AccessKeyID, err)
+	}
+	if value, _ := p.CloudWatch.(*cloudwatch.CloudWatch).Config.Credentials.Get(); value.AccessKeyID == "AKID" {
+		t.Errorf("CloudWatch client uses the static keys instead of the role")
+	}
+}
+
+func TestNewDynamoDBPluginWithSession(t *testing.T) {
+	sess := session.Must(session.NewSession(&aws.Config{
+		Region:      aws.String("us-west-2"),
+		Endpoint:    aws.String("http://127.0.0.1:4566"),
+		Credentials: credentials.NewStaticCredentials("AKID", "SECRET", ""),
+	}))
+	p := NewDynamoDBPluginWithSession(testTable, sess)
+	// the options of the plugin are not used with a session
+	p.Endpoint = "http://127.0.0.1:1"
+
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	cw := p.CloudWatch.(*cloudwatch.CloudWatch)
+	if endpoint := cw.ClientInfo.Endpoint; endpoint != "http://127.0.0.1:4566" {
+		t.Errorf("endpoint %s, want the mock endpoint of the session", endpoint)
+	}
+	if value, _ := cw.Config.Credentials.Get(); value.AccessKeyID != "AKID" {
+		t.Errorf("credentials %s, want the ones of the session", value.AccessKeyID)
+	}
+}
+
+func TestFetchMetricsRejectsUnknownStatistic(t *testing.T) {
+	cw := newFakeCloudWatch()
+	p := newTestPlugin(cw).WithMetricGroups([]MetricsGroup{
+		{CloudWatchName: "ConsumedReadCapacityUnits", Metrics: []Metric{
+			{MackerelName: "ConsumedReadP99", Type: "p99"},
+		}},
+	})
+	if _, err := p.FetchMetrics(); err == nil || !strings.Contains(err.Error(), `unknown statistic "p99"`) {
+		t.Errorf("FetchMetrics error = %v, want unknown statistic", err)
+	}
+	if len(cw.calls) != 0 {
+		t.Errorf("%d calls made before the validation", len(cw.calls))
+	}
+	if err := validateMetricsGroups(DefaultMetricsGroups()); err != nil {
+		t.Errorf("default groups are invalid: %s", err)
+	}
+}
+
+func TestLatencySeconds(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("SuccessfulRequestLatency", "Operation", "GetItem", datapoint(2*time.Minute, 12))
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 60))
+	p := newTestPlugin(cw)
+	p.LatencySeconds = true
+
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["SuccessfulRequestLatency.GetItem.Average"] != 0.012 {
+		t.Errorf("SuccessfulRequestLatency.GetItem.Average = %v, want 0.012 seconds", stats["SuccessfulRequestLatency.GetItem.Average"])
+	}
+	// the request count and other metrics are not latencies
+	if stats["SuccessfulRequests.GetItem"] != 12.0 || stats["ConsumedReadCapacityUnitsSum"] != 60.0 {
+		t.Errorf("non-latency metrics are converted: %v, %v", stats["SuccessfulRequests.GetItem"], stats["ConsumedReadCapacityUnitsSum"])
+	}
+	graph := p.GraphDefinition()["SuccessfulRequestLatency.#"]
+	if graph.Unit != "float" || !strings.HasSuffix(graph.Label, "(seconds)") {
+		t.Errorf("SuccessfulRequestLatency.# is %q in %s, want seconds in float", graph.Label, graph.Unit)
+	}
+
+	p.LatencySeconds = false
+	p.Reset()
+	p.CloudWatch = cw
+	if stats, _ := p.FetchMetrics(); stats["SuccessfulRequestLatency.GetItem.Average"] != 12.0 {
+		t.Errorf("SuccessfulRequestLatency.GetItem.Average = %v, want 12 milliseconds by default", stats["SuccessfulRequestLatency.GetItem.Average"])
+	}
+}
+
+func TestDiscoverListsAllPages(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.pageSize = 2
+	cw.add("ConsumedReadCapacityUnits", "", "")
+	cw.add("ConsumedReadCapacityUnits", "GlobalSecondaryIndexName", "by-user")
+	cw.add("ConsumedReadCapacityUnits", "GlobalSecondaryIndexName", "by-date")
+	cw.add("ConsumedWriteCapacityUnits", "", "")
+	p := newTestPlugin(cw)
+
+	var out bytes.Buffer
+	if err := p.discover(&out); err != nil {
+		t.Fatalf("discover: %s", err)
+	}
+	want := "ConsumedReadCapacityUnits\tGlobalSecondaryIndexName=by-date, TableName=test-table\n" +
+		"ConsumedReadCapacityUnits\tGlobalSecondaryIndexName=by-user, TableName=test-table\n" +
+		"ConsumedReadCapacityUnits\tTableName=test-table\n" +
+		"ConsumedWriteCapacityUnits\tTableName=test-table\n"
+	if out.String() != want {
+		t.Errorf("discover output:\n%s\nwant the metrics of both pages:\n%s", out.String(), want)
+	}
+}
+
+func TestSelectDatapointStrategies(t *testing.T) {
+	// the latest first, as getLastPointsFromCloudWatch sorts them
+	datapoints := []*cloudwatch.Datapoint{
+		datapoint(time.Minute, 3),
+		datapoint(2*time.Minute, 9),
+		datapoint(3*time.Minute, 6),
+	}
+	cases := map[string]float64{
+		"":           3,
+		selectLatest: 3,
+		selectFirst:  6,
+		selectMax:    9,
+		selectAvg:    6,
+	}
+	for strategy, want := range cases {
+		p := newTestPlugin(nil)
+		p.Select = strategy
+		dp := p.selectDatapoint(datapoints, metricsTypeSum)
+		if dp == nil || *dp.Sum != want {
+			t.Errorf("-select=%s selected %v, want %v", strategy, dp, want)
+		}
+	}
+
+	p := newTestPlugin(nil)
+	p.Select = selectAvg
+	if dp := p.selectDatapoint(datapoints, metricsTypeMaximum); dp == nil || *dp.Maximum != 6 || !dp.Timestamp.Equal(*datapoints[0].Timestamp) {
+		t.Errorf("-select=avg selected %v, want 6 at the time of the latest datapoint", dp)
+	}
+	if dp := p.selectDatapoint(nil, metricsTypeSum); dp != nil {
+		t.Errorf("-select=avg selected %v without datapoints", dp)
+	}
+}
+
+func TestPrepareSigningRegion(t *testing.T) {
+	p := &DynamoDBPlugin{
+		TableName:       testTable,
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		Endpoint:        "https://monitoring.proxy.example.com",
+		SigningRegion:   "us-west-2",
+	}
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	req, _ := p.CloudWatch.(*cloudwatch.CloudWatch).GetMetricStatisticsRequest(&cloudwatch.GetMetricStatisticsInput{})
+	if err := req.Sign(); err != nil {
+		t.Fatalf("Sign: %s", err)
+	}
+	if auth := req.HTTPRequest.Header.Get("Authorization"); !strings.Contains(auth, "/us-west-2/monitoring/aws4_request") {
+		t.Errorf("the request is signed as %q, want for us-west-2", auth)
+	}
+}
+
+func TestPrepareFIPS(t *testing.T) {
+	newPlugin := func(region string) *DynamoDBPlugin {
+		return &DynamoDBPlugin{
+			TableName:       testTable,
+			Region:          region,
+			AccessKeyID:     "AKID",
+			SecretAccessKey: "SECRET",
+			FIPS:            true,
+		}
+	}
+
+	p := newPlugin("us-east-1")
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	if endpoint := p.CloudWatch.(*cloudwatch.CloudWatch).ClientInfo.Endpoint; !strings.Contains(endpoint, "fips") {
+		t.Errorf("CloudWatch endpoint = %s, want the FIPS one", endpoint)
+	}
+
+	for _, region := range []string{"ap-northeast-1", "xx-nowhere-1"} {
+		if err := newPlugin(region).prepare(); err == nil {
+			t.Errorf("prepare succeeded with -fips in %s, without the FIPS endpoint of CloudWatch", region)
+		}
+	}
+
+	p = newPlugin("us-east-1")
+	p.Endpoint = "https://monitoring.proxy.example.com"
+	if err := p.prepare(); err == nil {
+		t.Error("prepare succeeded with both -fips and -endpoint")
+	}
+}
+
+func TestTrendReportsTheLastCompleteHour(t *testing.T) {
+	cw := newFakeCloudWatch()
+	// testNow is 03:04, 4 minutes into the hour of the latest datapoint
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(4*time.Minute, 60), datapoint(64*time.Minute, 7200))
+	p := newTestPlugin(cw)
+	p.Trend = true
+
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["ConsumedReadCapacityUnitsHourlySum"] != 7200.0 || stats["ConsumedReadCapacityUnitsHourlyNormalized"] != 2.0 {
+		t.Errorf("hourly sum %v (%v per second), want 7200 of the hour which has ended", stats["ConsumedReadCapacityUnitsHourlySum"], stats["ConsumedReadCapacityUnitsHourlyNormalized"])
+	}
+}
+
+func TestUserErrorRate(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("UserErrors", "", "", datapoint(2*time.Minute, 20))
+	cw.add("SuccessfulRequestLatency", "Operation", "GetItem", datapoint(2*time.Minute, 50))
+	cw.add("SuccessfulRequestLatency", "Operation", "PutItem", datapoint(2*time.Minute, 30))
+
+	stats, err := newTestPlugin(cw).FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["UserErrorRate"] != 20.0 {
+		t.Errorf("UserErrorRate = %v, want 20 of 20 / (80 + 20)", stats["UserErrorRate"])
+	}
+
+	p := newTestPlugin(cw)
+	p.Operations = map[string]bool{"GetItem": true}
+	stats, err = p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if rate, ok := stats["UserErrorRate"]; ok {
+		t.Errorf("UserErrorRate = %v with -operations, whose requests are only some of the operations", rate)
+	}
+}
@@ -0,0 +1,102 @@
+package mpawsdynamodb
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// metricStatQuery is a GetMetricData query of a DynamoDB metric, used as an input of expressions and not returned
+func metricStatQuery(id string, metricName string, stat string, dimensions []*cloudwatch.Dimension) *cloudwatch.MetricDataQuery {
+	return &cloudwatch.MetricDataQuery{
+		Id: aws.String(id),
+		MetricStat: &cloudwatch.MetricStat{
+			Metric: &cloudwatch.Metric{
+				Namespace:  aws.String(namespace),
+				MetricName: aws.String(metricName),
+				Dimensions: dimensions,
+			},
+			Period: aws.Int64(metricsPeriod),
+			Stat:   aws.String(stat),
+		},
+		ReturnData: aws.Bool(false),
+	}
+}
+
+// expressionQuery is a GetMetricData query computed by CloudWatch metric math, reported as the Mackerel metric label
+func expressionQuery(id string, expression string, label string) *cloudwatch.MetricDataQuery {
+	return &cloudwatch.MetricDataQuery{
+		Id:         aws.String(id),
+		Expression: aws.String(expression),
+		Label:      aws.String(label),
+		ReturnData: aws.Bool(true),
+	}
+}
+
+// utilizationQueries computes consumed capacity per second against provisioned capacity in percent on the server side
+func utilizationQueries(dimensions []*cloudwatch.Dimension) []*cloudwatch.MetricDataQuery {
+	return []*cloudwatch.MetricDataQuery{
+		metricStatQuery("consumedRead", "ConsumedReadCapacityUnits", metricsTypeSum, dimensions),
+		metricStatQuery("provisionedRead", "ProvisionedReadCapacityUnits", metricsTypeAverage, dimensions),
+		expressionQuery("readUtilization", "100 * (consumedRead / PERIOD(consumedRead)) / provisionedRead", "ReadCapacityUtilization"),
+		metricStatQuery("consumedWrite", "ConsumedWriteCapacityUnits", metricsTypeSum, dimensions),
+		metricStatQuery("provisionedWrite", "ProvisionedWriteCapacityUnits", metricsTypeAverage, dimensions),
+		expressionQuery("writeUtilization", "100 * (consumedWrite / PERIOD(consumedWrite)) / provisionedWrite", "WriteCapacityUtilization"),
+	}
+}
+
+// allTablesQueries sums consumed capacity of all tables in the region.
+// GetMetricStatistics without dimensions doesn't aggregate over tables, so this uses SEARCH of metric math,
+// which covers up to 500 tables
+func allTablesQueries() []*cloudwatch.MetricDataQuery {
+	search := func(metricName string) string {
+		return fmt.Sprintf(`SUM(SEARCH('{%s,TableName} MetricName="%s"', '%s', %d)) / %d`, namespace, metricName, metricsTypeSum, metricsPeriod, metricsPeriod)
+	}
+	return []*cloudwatch.MetricDataQuery{
+		expressionQuery("allTablesRead", search("ConsumedReadCapacityUnits"), "AllTablesConsumedReadCapacityUnitsNormalized"),
+		expressionQuery("allTablesWrite", search("ConsumedWriteCapacityUnits"), "AllTablesConsumedWriteCapacityUnitsNormalized"),
+	}
+}
+
+// fetchMetricData queries GetMetricData following NextToken, and appends the latest value of each returned query to stats by its label
+func (p *DynamoDBPlugin) fetchMetricData(ctx aws.Context, queries []*cloudwatch.MetricDataQuery, stats map[string]interface{}) error {
+	now := p.currentTime()
+	if p.OwningAccount != "" {
+		// cross-account observability: query the metrics of the linked source account
+		for _, q := range queries {
+			if q.MetricStat != nil {
+				q.AccountId = aws.String(p.OwningAccount)
+			}
+		}
+	}
+	input := &cloudwatch.GetMetricDataInput{
+		// 8 min, since some metrics are aggregated over 5 min
+		StartTime:         aws.Time(now.Add(time.Duration(480) * time.Second * -1)),
+		EndTime:           aws.Time(now),
+		MetricDataQueries: queries,
+		ScanBy:            aws.String(cloudwatch.ScanByTimestampDescending),
+	}
+	for {
+		res, err := p.CloudWatch.GetMetricDataWithContext(ctx, input)
+		if err != nil {
+			return err
+		}
+		for _, result := range res.MetricDataResults {
+			label := aws.StringValue(result.Label)
+			// values are the latest first, and later pages have older values
+			if _, ok := stats[label]; ok || len(result.Values) == 0 {
+				continue
+			}
+			stats[label] = aws.Float64Value(result.Values[0])
+			if len(result.Timestamps) > 0 && p.timestamps != nil {
+				p.timestamps[label] = aws.TimeValue(result.Timestamps[0])
+			}
+		}
+		if res.NextToken == nil {
+			return nil
+		}
+		input.NextToken = res.NextToken
+	}
+}
@@ -0,0 +1,77 @@
+package mpawsdynamodb
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+func TestFetchMetricDataFollowsNextToken(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.metricData = []*cloudwatch.GetMetricDataOutput{
+		{
+			MetricDataResults: []*cloudwatch.MetricDataResult{{
+				Label:      aws.String("ReadCapacityUtilization"),
+				Timestamps: []*time.Time{aws.Time(testNow.Add(-2 * time.Minute))},
+				Values:     []*float64{aws.Float64(40)},
+			}},
+			NextToken: aws.String("1"),
+		},
+		{
+			MetricDataResults: []*cloudwatch.MetricDataResult{{
+				Label:      aws.String("ReadCapacityUtilization"),
+				Timestamps: []*time.Time{aws.Time(testNow.Add(-3 * time.Minute))},
+				Values:     []*float64{aws.Float64(30)},
+			}, {
+				Label:      aws.String("WriteCapacityUtilization"),
+				Timestamps: []*time.Time{aws.Time(testNow.Add(-2 * time.Minute))},
+				Values:     []*float64{aws.Float64(20)},
+			}},
+		},
+	}
+	p := newTestPlugin(cw)
+	stats := make(map[string]interface{})
+
+	if err := p.fetchMetricData(context.Background(), utilizationQueries(p.tableDimensions()), stats); err != nil {
+		t.Fatalf("fetchMetricData: %s", err)
+	}
+	// the first page has the latest value
+	if stats["ReadCapacityUtilization"] != 40.0 {
+		t.Errorf("ReadCapacityUtilization = %v, want 40 of the first page", stats["ReadCapacityUtilization"])
+	}
+	if stats["WriteCapacityUtilization"] != 20.0 {
+		t.Errorf("WriteCapacityUtilization = %v, want 20 of the second page", stats["WriteCapacityUtilization"])
+	}
+}
+
+func TestOwningAccount(t *testing.T) {
+	cw := newFakeCloudWatch()
+	p := newTestPlugin(cw)
+	p.OwningAccount = "123456789012"
+	p.Utilization = true
+
+	if _, err := p.FetchMetrics(); err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if len(cw.metricDataInputs) != 1 {
+		t.Fatalf("%d GetMetricData calls, want 1", len(cw.metricDataInputs))
+	}
+	for _, q := range cw.metricDataInputs[0].MetricDataQueries {
+		// expressions take the account of their inputs
+		want := ""
+		if q.MetricStat != nil {
+			want = p.OwningAccount
+		}
+		if account := aws.StringValue(q.AccountId); account != want {
+			t.Errorf("AccountId of %s = %q, want %q", aws.StringValue(q.Id), account, want)
+		}
+	}
+
+	p.AggregateAllTables = true
+	if _, err := p.FetchMetrics(); err == nil {
+		t.Error("FetchMetrics succeeded with AggregateAllTables, whose SEARCH queries can't read the owning account")
+	}
+}
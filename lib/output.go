@@ -0,0 +1,248 @@
+package mpawsdynamodb
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math"
+	"net"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// writeToFile writes the output of fn to path.
+// The output is written to a temporary file in the same directory and renamed to path at the end,
+// so that readers never see a partially written file. The temporary file is removed when anything fails
+func writeToFile(path string, fn func(io.Writer) error) (err error) {
+	f, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if err != nil {
+			f.Close()
+			os.Remove(f.Name())
+		}
+	}()
+
+	if err := fn(f); err != nil {
+		return err
+	}
+	// flushed before the rename, so that a crash never leaves path empty
+	if err := f.Sync(); err != nil {
+		return err
+	}
+	if err := f.Close(); err != nil {
+		return err
+	}
+	return os.Rename(f.Name(), path)
+}
+
+// writeToSocket writes the output of fn to the Unix domain socket at path.
+// When the socket cannot be written, the output is written to fallback (stderr) instead so that the metrics are not lost silently
+func writeToSocket(path string, fn func(io.Writer) error, fallback io.Writer) error {
+	var buf bytes.Buffer
+	if err := fn(&buf); err != nil {
+		return err
+	}
+	if err := sendToSocket(path, buf.Bytes()); err != nil {
+		log.Printf("failed to write to socket %s, falling back to stderr: %s", path, err)
+		_, err := fallback.Write(buf.Bytes())
+		return err
+	}
+	return nil
+}
+
+func sendToSocket(path string, b []byte) error {
+	conn, err := net.Dial("unix", path)
+	if err != nil {
+		return err
+	}
+	if _, err := conn.Write(b); err != nil {
+		conn.Close()
+		return err
+	}
+	return conn.Close()
+}
+
+// formatValue formats a metric value for the text outputs
+func formatValue(value interface{}) string {
+	if v, ok := value.(float64); ok {
+		return strconv.FormatFloat(v, 'f', -1, 64)
+	}
+	return fmt.Sprint(value)
+}
+
+// roundValue rounds a float value to Precision significant digits for the text outputs, so that small values such as
+// latencies in seconds keep their digits. The value is rounded rather than formatted, so that 1.50 is still written as 1.5
+func (p *DynamoDBPlugin) roundValue(value interface{}) interface{} {
+	v, ok := value.(float64)
+	if !ok || p.Precision <= 0 || math.IsNaN(v) || math.IsInf(v, 0) {
+		return value
+	}
+	rounded, err := strconv.ParseFloat(strconv.FormatFloat(v, 'g', p.Precision, 64), 64)
+	if err != nil {
+		return value
+	}
+	return rounded
+}
+
+// outputMetric is a metric to write: its key in the stats of FetchMetrics, and its name in the output
+type outputMetric struct {
+	key  string
+	name string
+}
+
+// outputMetrics returns the metrics of stats drawn by GraphDefinition, sorted by the names go-mackerel-plugin-helper gives them:
+// "<prefix>.<graph>.<metric>" for a line of a graph, or "<prefix>.<key>" for a key matching a line with a wildcard
+func (p *DynamoDBPlugin) outputMetrics(stats map[string]interface{}) []outputMetric {
+	prefix := p.MetricKeyPrefix()
+	names := make(map[string]string)
+	for graphKey, graph := range p.GraphDefinition() {
+		for _, m := range graph.Metrics {
+			if !strings.ContainsAny(graphKey+m.Name, "*#") {
+				if _, ok := stats[m.Name]; ok {
+					names[m.Name] = prefix + "." + graphKey + "." + m.Name
+				}
+				continue
+			}
+			pattern := regexp.QuoteMeta(graphKey + "." + m.Name)
+			pattern = strings.NewReplacer(`\*`, "[-a-zA-Z0-9_]+", "#", "[-a-zA-Z0-9_]+").Replace(pattern)
+			re := regexp.MustCompile("^" + pattern + "$")
+			for key := range stats {
+				if re.MatchString(key) {
+					names[key] = prefix + "." + key
+				}
+			}
+		}
+	}
+
+	metrics := make([]outputMetric, 0, len(names))
+	for key, name := range names {
+		metrics = append(metrics, outputMetric{key: key, name: name})
+	}
+	sort.Slice(metrics, func(i, j int) bool {
+		return metrics[i].name < metrics[j].name
+	})
+	return metrics
+}
+
+// outputMackerel fetches the metrics and writes them as go-mackerel-plugin-helper does, "<name>\t<value>\t<timestamp>" per line
+// with the time of the run, but with a single write at the end rather than a write per line
+func (p *DynamoDBPlugin) outputMackerel(w io.Writer) error {
+	now := p.currentTime()
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	for _, m := range p.outputMetrics(stats) {
+		v, ok := stats[m.key].(float64)
+		if !ok || math.IsNaN(v) || math.IsInf(v, 0) {
+			log.Printf("Invalid value, skip: %s = %v", m.name, stats[m.key])
+			continue
+		}
+		fmt.Fprintf(&buf, "%s\t%f\t%d\n", m.name, v, now.Unix())
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// outputTime returns the timestamp to write for the metric: the time of its datapoint, or now for metrics without one,
+// shifted by TimestampOffset
+func (p *DynamoDBPlugin) outputTime(key string, now time.Time) time.Time {
+	t, ok := p.timestamps[key]
+	if !ok {
+		t = now
+	}
+	return t.Add(p.TimestampOffset)
+}
+
+// outputGraphite fetches the metrics and writes them as Graphite plaintext lines "<name> <value> <timestamp>",
+// with the names of outputMackerel and the timestamp of the datapoint (or the time of the run for metrics without one)
+func (p *DynamoDBPlugin) outputGraphite(w io.Writer) error {
+	now := p.currentTime()
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		return err
+	}
+	// written with a single write at the end rather than a write per line
+	var buf bytes.Buffer
+	for _, m := range p.outputMetrics(stats) {
+		t := p.outputTime(m.key, now)
+		fmt.Fprintf(&buf, "%s %s %d\n", m.name, formatValue(p.roundValue(stats[m.key])), t.Unix())
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// jsonLine is a metric in the JSON Lines output
+type jsonLine struct {
+	Name  string      `json:"name"`
+	Value interface{} `json:"value"`
+	Time  int64       `json:"time"`
+}
+
+// outputJSONLines fetches the metrics and writes them as JSON objects {"name":"<name>","value":...,"time":...} one per line,
+// with the same names and timestamps as outputGraphite. NaN values are written as null, since JSON has no NaN
+func (p *DynamoDBPlugin) outputJSONLines(w io.Writer) error {
+	now := p.currentTime()
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		return err
+	}
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	for _, m := range p.outputMetrics(stats) {
+		t := p.outputTime(m.key, now)
+		value := p.roundValue(stats[m.key])
+		if v, ok := value.(float64); ok && math.IsNaN(v) {
+			value = nil
+		}
+		if err := enc.Encode(jsonLine{Name: m.name, Value: value, Time: t.Unix()}); err != nil {
+			return err
+		}
+	}
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
+// dropUnchanged removes the metrics whose value is the same as recorded in path by the last run, and records the current values there
+func dropUnchanged(path string, stats map[string]interface{}) error {
+	last := make(map[string]float64)
+	b, err := ioutil.ReadFile(path)
+	if err == nil {
+		if err := json.Unmarshal(b, &last); err != nil {
+			return err
+		}
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+
+	current := make(map[string]float64, len(stats))
+	for key, value := range stats {
+		v, ok := value.(float64)
+		// NaN never equals itself, and JSON can't encode it anyway
+		if !ok || math.IsNaN(v) {
+			continue
+		}
+		current[key] = v
+		if lastValue, ok := last[key]; ok && lastValue == v {
+			delete(stats, key)
+		}
+	}
+
+	b, err = json.Marshal(current)
+	if err != nil {
+		return err
+	}
+	return ioutil.WriteFile(path, b, 0644)
+}
@@ -0,0 +1,313 @@
+package mpawsdynamodb
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestRoundValue(t *testing.T) {
+	p := &DynamoDBPlugin{Precision: 2}
+	cases := []struct {
+		value, want interface{}
+	}{
+		{0.0034567, 0.0035},
+		{1.50, 1.5},
+		{123.456, 120.0},
+		{"text", "text"},
+	}
+	for _, c := range cases {
+		if got := p.roundValue(c.value); got != c.want {
+			t.Errorf("roundValue(%v) = %v, want %v", c.value, got, c.want)
+		}
+	}
+	if got := p.roundValue(math.NaN()).(float64); !math.IsNaN(got) {
+		t.Errorf("roundValue(NaN) = %v", got)
+	}
+	all := &DynamoDBPlugin{}
+	if got := all.roundValue(1.0 / 3); got != 1.0/3 {
+		t.Errorf("roundValue(1/3) = %v without Precision, want all the digits", got)
+	}
+}
+
+func TestOutputGraphitePrecision(t *testing.T) {
+	cw := newFakeCloudWatch()
+	// normalized to 0.0034 per second
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 0.204))
+	p := newTestPlugin(cw)
+	p.Precision = 2
+
+	var out bytes.Buffer
+	if err := p.outputGraphite(&out); err != nil {
+		t.Fatalf("outputGraphite: %s", err)
+	}
+	if want := "dynamodb.ReadCapacity.ConsumedReadCapacityUnitsNormalized 0.0034 "; !strings.Contains(out.String(), want) {
+		t.Errorf("output has no %q:\n%s", want, out.String())
+	}
+}
+
+func TestOutputNaNMetrics(t *testing.T) {
+	p := newTestPlugin(newFakeCloudWatch())
+	p.NaNMetrics = []string{"ConsumedReadCapacityUnitsNormalized"}
+
+	var graphite bytes.Buffer
+	if err := p.outputGraphite(&graphite); err != nil {
+		t.Fatalf("outputGraphite: %s", err)
+	}
+	if want := "dynamodb.ReadCapacity.ConsumedReadCapacityUnitsNormalized NaN "; !strings.Contains(graphite.String(), want) {
+		t.Errorf("graphite output has no %q:\n%s", want, graphite.String())
+	}
+
+	var jsonl bytes.Buffer
+	if err := p.outputJSONLines(&jsonl); err != nil {
+		t.Fatalf("outputJSONLines: %s", err)
+	}
+	if want := `{"name":"dynamodb.ReadCapacity.ConsumedReadCapacityUnitsNormalized","value":null,`; !strings.Contains(jsonl.String(), want) {
+		t.Errorf("jsonl output has no %q:\n%s", want, jsonl.String())
+	}
+}
+
+func TestOutputMackerel(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 120))
+	cw.add("SuccessfulRequestLatency", "Operation", "GetItem", datapoint(2*time.Minute, 3.25))
+	p := newTestPlugin(cw)
+
+	var out bytes.Buffer
+	if err := p.outputMackerel(&out); err != nil {
+		t.Fatalf("outputMackerel: %s", err)
+	}
+	for _, want := range []string{
+		fmt.Sprintf("dynamodb.ReadCapacity.ConsumedReadCapacityUnitsNormalized\t2.000000\t%d\n", testNow.Unix()),
+		fmt.Sprintf("dynamodb.SuccessfulRequestLatency.GetItem.Average\t3.250000\t%d\n", testNow.Unix()),
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("output has no %q:\n%s", want, out.String())
+		}
+	}
+	// not drawn on any graph
+	if strings.Contains(out.String(), "ConsumedReadCapacityUnitsSum") {
+		t.Errorf("output has the sum, which no graph draws:\n%s", out.String())
+	}
+}
+
+// outputNames returns the metric names written by output, taken as the text up to the first tab or space of each line
+// or the "name" of a JSON line
+func outputNames(t *testing.T, output func(io.Writer) error) []string {
+	var out bytes.Buffer
+	if err := output(&out); err != nil {
+		t.Fatal(err)
+	}
+	var names []string
+	for _, line := range strings.Split(strings.TrimSpace(out.String()), "\n") {
+		if strings.HasPrefix(line, "{") {
+			var l jsonLine
+			if err := json.Unmarshal([]byte(line), &l); err != nil {
+				t.Fatal(err)
+			}
+			names = append(names, l.Name)
+			continue
+		}
+		names = append(names, strings.FieldsFunc(line, func(r rune) bool { return r == '\t' || r == ' ' })[0])
+	}
+	return names
+}
+
+func TestOutputNamesMatchMackerel(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 120))
+	cw.add("ReadThrottleEvents", "", "", datapoint(2*time.Minute, 3))
+	cw.add("SuccessfulRequestLatency", "Operation", "GetItem", datapoint(2*time.Minute, 3.25))
+	cw.add("ConsumedReadCapacityUnits", "GlobalSecondaryIndexName", "by-date", datapoint(2*time.Minute, 60))
+	cw.add("AccountMaxTableLevelReads", "", "", datapoint(2*time.Minute, 40000))
+	p := newTestPlugin(cw)
+	p.AccountID = "123456789012"
+	p.AccountMetrics = true
+	p.AccountSubPrefix = true
+
+	mackerel := outputNames(t, p.outputMackerel)
+	for _, want := range []string{
+		"dynamodb-123456789012.ReadCapacity.ConsumedReadCapacityUnitsNormalized",
+		"dynamodb-123456789012.ThrottledEvents.ReadThrottleEvents",
+		"dynamodb-123456789012.SuccessfulRequestLatency.GetItem.Average",
+		"dynamodb-123456789012.ReadCapacity.by-date.Consumed",
+		"dynamodb-123456789012.account.TableLevelQuotas.AccountMaxTableLevelReads",
+	} {
+		if !strings.Contains(strings.Join(mackerel, "\n")+"\n", want+"\n") {
+			t.Errorf("mackerel output has no %s:\n%s", want, strings.Join(mackerel, "\n"))
+		}
+	}
+	for format, output := range map[string]func(io.Writer) error{
+		formatGraphite: p.outputGraphite,
+		formatJSONL:    p.outputJSONLines,
+	} {
+		if names := outputNames(t, output); !reflect.DeepEqual(names, mackerel) {
+			t.Errorf("%s names:\n%s\nwant the ones of mackerel:\n%s", format, strings.Join(names, "\n"), strings.Join(mackerel, "\n"))
+		}
+	}
+}
+
+// countingWriter counts the writes made to it
+type countingWriter struct {
+	writes int
+}
+
+func (w *countingWriter) Write(b []byte) (int, error) {
+	w.writes++
+	return len(b), nil
+}
+
+// newOutputTestPlugin returns a plugin whose output is well over a 4 KB buffer
+func newOutputTestPlugin() *DynamoDBPlugin {
+	cw := newFakeCloudWatch()
+	for _, mg := range defaultMetricsGroup {
+		cw.add(mg.CloudWatchName, "", "", datapoint(2*time.Minute, 1.5))
+	}
+	for _, op := range knownOperations {
+		cw.add("SuccessfulRequestLatency", "Operation", op, datapoint(2*time.Minute, 3.25))
+	}
+	return newTestPlugin(cw)
+}
+
+func TestOutputWritesOnce(t *testing.T) {
+	p := newOutputTestPlugin()
+	for format, output := range map[string]func(io.Writer) error{
+		formatMackerel: p.outputMackerel,
+		formatGraphite: p.outputGraphite,
+		formatJSONL:    p.outputJSONLines,
+	} {
+		w := &countingWriter{}
+		if err := output(w); err != nil {
+			t.Fatalf("%s: %s", format, err)
+		}
+		if w.writes != 1 {
+			t.Errorf("%s output written with %d writes, want 1", format, w.writes)
+		}
+	}
+}
+
+func BenchmarkOutputGraphite(b *testing.B) {
+	p := newOutputTestPlugin()
+
+	w := &countingWriter{}
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if err := p.outputGraphite(w); err != nil {
+			b.Fatal(err)
+		}
+	}
+	b.ReportMetric(float64(w.writes)/float64(b.N), "writes/op")
+	if w.writes != b.N {
+		b.Errorf("%d writes in %d runs, want one per run", w.writes, b.N)
+	}
+}
+
+func TestWriteToFile(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics")
+
+	err := writeToFile(path, func(w io.Writer) error {
+		_, err := io.WriteString(w, "dynamodb.ReadCapacity.ConsumedReadCapacityUnitsNormalized\t2.000000\t1\n")
+		return err
+	})
+	if err != nil {
+		t.Fatalf("writeToFile: %s", err)
+	}
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(b) != "dynamodb.ReadCapacity.ConsumedReadCapacityUnitsNormalized\t2.000000\t1\n" {
+		t.Errorf("file = %q", b)
+	}
+
+	// a failed run keeps the last output, and leaves no temporary file
+	fetchErr := errors.New("fetch failed")
+	err = writeToFile(path, func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return fetchErr
+	})
+	if err != fetchErr {
+		t.Errorf("writeToFile error = %v, want %v", err, fetchErr)
+	}
+	if b, _ := ioutil.ReadFile(path); !strings.HasPrefix(string(b), "dynamodb.") {
+		t.Errorf("file = %q after a failed run, want the last output", b)
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) != 1 {
+		for _, f := range files {
+			t.Errorf("file left in the directory: %s", f.Name())
+		}
+	}
+}
+
+func TestWriteToSocket(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "metrics.sock")
+	l, err := net.Listen("unix", path)
+	if err != nil {
+		t.Skipf("no Unix domain socket: %s", err)
+	}
+	defer l.Close()
+	received := make(chan string, 1)
+	go func() {
+		conn, err := l.Accept()
+		if err != nil {
+			received <- err.Error()
+			return
+		}
+		defer conn.Close()
+		b, _ := ioutil.ReadAll(conn)
+		received <- string(b)
+	}()
+
+	output := func(w io.Writer) error {
+		_, err := io.WriteString(w, "dynamodb.ThrottledEvents.ReadThrottleEvents 3 1\n")
+		return err
+	}
+	var fallback bytes.Buffer
+	if err := writeToSocket(path, output, &fallback); err != nil {
+		t.Fatalf("writeToSocket: %s", err)
+	}
+	if got := <-received; got != "dynamodb.ThrottledEvents.ReadThrottleEvents 3 1\n" {
+		t.Errorf("socket received %q", got)
+	}
+	if fallback.Len() > 0 {
+		t.Errorf("fallback written while the socket is up: %q", fallback.String())
+	}
+
+	// without a listener, the output goes to the fallback
+	if err := writeToSocket(filepath.Join(dir, "missing.sock"), output, &fallback); err != nil {
+		t.Fatalf("writeToSocket without a listener: %s", err)
+	}
+	if fallback.String() != "dynamodb.ThrottledEvents.ReadThrottleEvents 3 1\n" {
+		t.Errorf("fallback = %q", fallback.String())
+	}
+
+	// a failed run writes nothing
+	fetchErr := errors.New("fetch failed")
+	fallback.Reset()
+	err = writeToSocket(filepath.Join(dir, "missing.sock"), func(w io.Writer) error {
+		io.WriteString(w, "partial")
+		return fetchErr
+	}, &fallback)
+	if err != fetchErr {
+		t.Errorf("writeToSocket error = %v, want %v", err, fetchErr)
+	}
+	if fallback.Len() > 0 {
+		t.Errorf("fallback written by a failed run: %q", fallback.String())
+	}
+}
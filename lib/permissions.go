@@ -0,0 +1,137 @@
+package mpawsdynamodb
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// permissionCheck is a minimal API call made with the IAM action the plugin needs
+type permissionCheck struct {
+	action string
+	call   func(ctx aws.Context) error
+}
+
+// permissionChecks returns the checks of the actions needed with the options
+func (p *DynamoDBPlugin) permissionChecks() []permissionCheck {
+	now := p.currentTime()
+	checks := []permissionCheck{
+		{"cloudwatch:ListMetrics", func(ctx aws.Context) error {
+			_, err := p.CloudWatch.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{
+				Namespace:  aws.String(namespace),
+				MetricName: aws.String("ConsumedReadCapacityUnits"),
+			})
+			return err
+		}},
+		{"cloudwatch:GetMetricStatistics", func(ctx aws.Context) error {
+			_, err := p.CloudWatch.GetMetricStatisticsWithContext(ctx, &cloudwatch.GetMetricStatisticsInput{
+				StartTime:  aws.Time(now.Add(-time.Duration(metricsPeriod) * time.Second)),
+				EndTime:    aws.Time(now),
+				MetricName: aws.String("ConsumedReadCapacityUnits"),
+				Period:     aws.Int64(metricsPeriod),
+				Statistics: []*string{aws.String(metricsTypeSum)},
+				Namespace:  aws.String(namespace),
+				Dimensions: p.tableDimensions(),
+			})
+			return err
+		}},
+	}
+	if p.Utilization || p.AggregateAllTables {
+		checks = append(checks, permissionCheck{"cloudwatch:GetMetricData", func(ctx aws.Context) error {
+			_, err := p.CloudWatch.GetMetricDataWithContext(ctx, &cloudwatch.GetMetricDataInput{
+				StartTime:         aws.Time(now.Add(-time.Duration(metricsPeriod) * time.Second)),
+				EndTime:           aws.Time(now),
+				MetricDataQueries: []*cloudwatch.MetricDataQuery{metricStatQuery("m1", "ConsumedReadCapacityUnits", metricsTypeSum, p.tableDimensions())},
+			})
+			return err
+		}})
+	}
+	if p.FixTableNameCase {
+		checks = append(checks, permissionCheck{"dynamodb:ListTables", func(ctx aws.Context) error {
+			// the first page is enough
+			return p.DynamoDB.ListTablesPagesWithContext(ctx, &dynamodb.ListTablesInput{
+				Limit: aws.Int64(1),
+			}, func(page *dynamodb.ListTablesOutput, lastPage bool) bool {
+				return false
+			})
+		}})
+	}
+	// both read the table description
+	if p.BillingMode || p.GlobalTable {
+		checks = append(checks, permissionCheck{"dynamodb:DescribeTable", func(ctx aws.Context) error {
+			_, err := p.DynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+				TableName: aws.String(p.TableName),
+			})
+			return err
+		}})
+	}
+	return checks
+}
+
+// isAccessDenied tells whether err is the denial of an IAM action
+func isAccessDenied(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+	switch awsErr.Code() {
+	case "AccessDenied", "AccessDeniedException", "UnauthorizedOperation":
+		return true
+	}
+	return false
+}
+
+// iamPolicy is the JSON of an IAM policy, to suggest for the missing actions
+type iamPolicy struct {
+	Version   string
+	Statement []iamStatement
+}
+
+type iamStatement struct {
+	Effect   string
+	Action   []string
+	Resource string
+}
+
+// verifyPermissions makes the calls of permissionChecks, and writes which IAM actions are allowed and which are denied,
+// with a policy granting the denied ones. It returns an error when any is denied or fails otherwise
+func (p *DynamoDBPlugin) verifyPermissions(w io.Writer) error {
+	var denied []string
+	failed := 0
+	for _, check := range p.permissionChecks() {
+		err := check.call(context.Background())
+		switch {
+		case err == nil:
+			fmt.Fprintf(w, "%s\tallowed\n", check.action)
+		case isAccessDenied(err):
+			fmt.Fprintf(w, "%s\tdenied\n", check.action)
+			denied = append(denied, check.action)
+		default:
+			fmt.Fprintf(w, "%s\tunknown (%s)\n", check.action, err)
+			failed++
+		}
+	}
+
+	if len(denied) > 0 {
+		b, err := json.MarshalIndent(iamPolicy{
+			Version:   "2012-10-17",
+			Statement: []iamStatement{{Effect: "Allow", Action: denied, Resource: "*"}},
+		}, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(w, "\nGrant the denied actions with a policy such as:\n%s\n", b)
+		return fmt.Errorf("%d IAM actions denied", len(denied))
+	}
+	if failed > 0 {
+		return fmt.Errorf("%d checks failed for other reasons than permissions", failed)
+	}
+	return nil
+}
@@ -0,0 +1,87 @@
+package mpawsdynamodb
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+	"github.com/aws/aws-sdk-go/service/dynamodb/dynamodbiface"
+)
+
+// fakeDynamoDB answers DynamoDB API calls, denying the actions in denied
+type fakeDynamoDB struct {
+	dynamodbiface.DynamoDBAPI
+	tables []string
+	// returned by DescribeTable, or a description of the table name only if nil
+	table  *dynamodb.TableDescription
+	denied map[string]bool
+}
+
+var errDenied = awserr.NewRequestFailure(awserr.New("AccessDeniedException", "not authorized", nil), 400, "")
+
+func (f *fakeDynamoDB) DescribeTableWithContext(ctx aws.Context, input *dynamodb.DescribeTableInput, opts ...request.Option) (*dynamodb.DescribeTableOutput, error) {
+	if f.denied["dynamodb:DescribeTable"] {
+		return nil, errDenied
+	}
+	if f.table != nil {
+		return &dynamodb.DescribeTableOutput{Table: f.table}, nil
+	}
+	return &dynamodb.DescribeTableOutput{Table: &dynamodb.TableDescription{TableName: input.TableName}}, nil
+}
+
+func (f *fakeDynamoDB) ListTablesPagesWithContext(ctx aws.Context, input *dynamodb.ListTablesInput, fn func(*dynamodb.ListTablesOutput, bool) bool, opts ...request.Option) error {
+	if f.denied["dynamodb:ListTables"] {
+		return errDenied
+	}
+	fn(&dynamodb.ListTablesOutput{TableNames: aws.StringSlice(f.tables)}, true)
+	return nil
+}
+
+// checkedActions returns the actions of permissionChecks
+func checkedActions(p *DynamoDBPlugin) string {
+	var actions []string
+	for _, check := range p.permissionChecks() {
+		actions = append(actions, check.action)
+	}
+	return strings.Join(actions, ",")
+}
+
+func TestPermissionChecksListTablesWithFixTableNameCase(t *testing.T) {
+	p := newTestPlugin(newFakeCloudWatch())
+	if actions := checkedActions(p); strings.Contains(actions, "dynamodb:ListTables") {
+		t.Errorf("dynamodb:ListTables is checked without FixTableNameCase: %s", actions)
+	}
+	p.FixTableNameCase = true
+	p.DynamoDB = &fakeDynamoDB{denied: map[string]bool{"dynamodb:ListTables": true}}
+
+	var out bytes.Buffer
+	if err := p.verifyPermissions(&out); err == nil {
+		t.Errorf("no error for the denied dynamodb:ListTables")
+	}
+	if !strings.Contains(out.String(), "dynamodb:ListTables\tdenied") {
+		t.Errorf("dynamodb:ListTables is not reported as denied:\n%s", out.String())
+	}
+}
+
+func TestPermissionChecksDescribeTable(t *testing.T) {
+	cases := []struct {
+		billingMode, globalTable bool
+		want                     bool
+	}{
+		{false, false, false},
+		{true, false, true},
+		{false, true, true},
+	}
+	for _, c := range cases {
+		p := newTestPlugin(newFakeCloudWatch())
+		p.BillingMode = c.billingMode
+		p.GlobalTable = c.globalTable
+		if got := strings.Contains(checkedActions(p), "dynamodb:DescribeTable"); got != c.want {
+			t.Errorf("dynamodb:DescribeTable checked = %v with BillingMode %v and GlobalTable %v, want %v", got, c.billingMode, c.globalTable, c.want)
+		}
+	}
+}
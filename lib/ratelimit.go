@@ -0,0 +1,84 @@
+package mpawsdynamodb
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+)
+
+// how long to try to take the lock of the rate limit file
+const rateLimitLockTimeout = time.Second
+
+// rateLimiter spaces out calls of all the processes sharing the file at Path to Rate calls per second.
+// The file holds the time the next call is allowed at, updated under a lock of the file itself (see lockFile).
+// It's best-effort: when the file can't be used, the call is made without waiting
+type rateLimiter struct {
+	Path string
+	Rate float64
+}
+
+// wait blocks until the next call is allowed, or ctx is done
+func (l *rateLimiter) wait(ctx aws.Context) {
+	at, err := l.reserve(time.Now())
+	if err != nil {
+		log.Printf("Rate limit file unavailable, call without waiting: %s", err)
+		return
+	}
+	timer := time.NewTimer(time.Until(at))
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+	case <-ctx.Done():
+	}
+}
+
+// reserve takes the next call slot, and returns the time of it
+func (l *rateLimiter) reserve(now time.Time) (time.Time, error) {
+	f, err := os.OpenFile(l.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return now, err
+	}
+	// also releases the lock
+	defer f.Close()
+	if err := lockFile(f, rateLimitLockTimeout); err != nil {
+		return now, err
+	}
+
+	b, err := ioutil.ReadAll(f)
+	if err != nil {
+		return now, err
+	}
+	at := now
+	// a broken file is overwritten below
+	if next, err := strconv.ParseInt(strings.TrimSpace(string(b)), 10, 64); err == nil && time.Unix(0, next).After(at) {
+		at = time.Unix(0, next)
+	}
+	next := at.Add(time.Duration(float64(time.Second) / l.Rate))
+	if err := f.Truncate(0); err != nil {
+		return now, err
+	}
+	if _, err := f.WriteAt([]byte(strconv.FormatInt(next.UnixNano(), 10)), 0); err != nil {
+		return now, err
+	}
+	return at, nil
+}
+
+// rateLimitedCloudWatch waits for the rate limiter before each GetMetricStatistics call, which are the bulk of the calls
+type rateLimitedCloudWatch struct {
+	cloudwatchiface.CloudWatchAPI
+	limiter *rateLimiter
+}
+
+// GetMetricStatisticsWithContext calls GetMetricStatistics once the rate limiter allows
+func (c *rateLimitedCloudWatch) GetMetricStatisticsWithContext(ctx aws.Context, input *cloudwatch.GetMetricStatisticsInput, opts ...request.Option) (*cloudwatch.GetMetricStatisticsOutput, error) {
+	c.limiter.wait(ctx)
+	return c.CloudWatchAPI.GetMetricStatisticsWithContext(ctx, input, opts...)
+}
@@ -0,0 +1,30 @@
+//go:build !windows
+// +build !windows
+
+package mpawsdynamodb
+
+import (
+	"errors"
+	"os"
+	"syscall"
+	"time"
+)
+
+// lockFile takes the exclusive flock of the file, trying for up to timeout.
+// The lock is released when the file is closed, or by the OS when the process dies, so a crash never leaves it behind
+func lockFile(f *os.File, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		err := syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+		if err == nil {
+			return nil
+		}
+		if err != syscall.EWOULDBLOCK && err != syscall.EINTR {
+			return err
+		}
+		if time.Now().After(deadline) {
+			return errors.New("timed out taking the lock of " + f.Name())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
@@ -0,0 +1,38 @@
+//go:build !windows
+// +build !windows
+
+package mpawsdynamodb
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterLockReleasedByClose(t *testing.T) {
+	l := &rateLimiter{Path: filepath.Join(t.TempDir(), "rate-limit"), Rate: 10}
+
+	// another process holding the lock, as each open of the file takes its own flock
+	holder, err := os.OpenFile(l.Path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := lockFile(holder, 0); err != nil {
+		t.Fatalf("lockFile: %s", err)
+	}
+	f, err := os.Open(l.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	if err := lockFile(f, 50*time.Millisecond); err == nil {
+		t.Fatal("the lock is taken while held by another")
+	}
+
+	// the OS releases the lock of a process which died holding it, as closing does
+	holder.Close()
+	if _, err := l.reserve(testNow); err != nil {
+		t.Errorf("reserve after the holder is gone: %s", err)
+	}
+}
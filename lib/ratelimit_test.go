@@ -0,0 +1,31 @@
+package mpawsdynamodb
+
+import (
+	"io/ioutil"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestRateLimiterReserve(t *testing.T) {
+	l := &rateLimiter{Path: filepath.Join(t.TempDir(), "rate-limit"), Rate: 10}
+	// a broken file is overwritten
+	if err := ioutil.WriteFile(l.Path, []byte("broken"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < 3; i++ {
+		at, err := l.reserve(testNow)
+		if err != nil {
+			t.Fatalf("reserve: %s", err)
+		}
+		if want := testNow.Add(time.Duration(i) * 100 * time.Millisecond); !at.Equal(want) {
+			t.Errorf("slot %d at %s, want %s", i, at, want)
+		}
+	}
+	// the slots reserved in the past don't delay a call later on
+	later := testNow.Add(time.Minute)
+	if at, err := l.reserve(later); err != nil || !at.Equal(later) {
+		t.Errorf("slot at %s (%v), want %s", at, err, later)
+	}
+}
@@ -0,0 +1,55 @@
+package mpawsdynamodb
+
+import (
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+)
+
+// retryAfterRetryer is the jittered backoff of client.DefaultRetryer,
+// except that it waits as long as the Retry-After header of the response tells when there is one, up to MaxThrottleDelay.
+// The wait is still bounded by the deadline of the run
+type retryAfterRetryer struct {
+	client.DefaultRetryer
+}
+
+// RetryRules returns the delay before the next retry
+func (r retryAfterRetryer) RetryRules(req *request.Request) time.Duration {
+	if req.HTTPResponse != nil {
+		if delay, ok := parseRetryAfter(req.HTTPResponse.Header.Get("Retry-After"), time.Now()); ok {
+			// a misbehaving endpoint mustn't hold the run for hours
+			limit := r.MaxThrottleDelay
+			if limit == 0 {
+				limit = client.DefaultRetryerMaxThrottleDelay
+			}
+			if delay > limit {
+				return limit
+			}
+			return delay
+		}
+	}
+	return r.DefaultRetryer.RetryRules(req)
+}
+
+// parseRetryAfter parses the value of a Retry-After header, either seconds or an HTTP date
+func parseRetryAfter(value string, now time.Time) (time.Duration, bool) {
+	if value == "" {
+		return 0, false
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		if seconds < 0 {
+			return 0, false
+		}
+		return time.Duration(seconds) * time.Second, true
+	}
+	if t, err := http.ParseTime(value); err == nil {
+		if delay := t.Sub(now); delay > 0 {
+			return delay, true
+		}
+		return 0, true
+	}
+	return 0, false
+}
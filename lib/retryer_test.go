@@ -0,0 +1,91 @@
+package mpawsdynamodb
+
+import (
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/client"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+)
+
+// throttledRequest returns a request answered 429 with the Retry-After header
+func throttledRequest(retryAfter string) *request.Request {
+	header := http.Header{}
+	if retryAfter != "" {
+		header.Set("Retry-After", retryAfter)
+	}
+	return &request.Request{HTTPResponse: &http.Response{StatusCode: http.StatusTooManyRequests, Header: header}}
+}
+
+func TestRetryAfterRetryer(t *testing.T) {
+	r := retryAfterRetryer{client.DefaultRetryer{
+		NumMaxRetries:    3,
+		MinThrottleDelay: time.Second,
+		MaxThrottleDelay: time.Minute,
+	}}
+	if delay := r.RetryRules(throttledRequest("7")); delay != 7*time.Second {
+		t.Errorf("delay %s, want 7s of Retry-After", delay)
+	}
+	if delay := r.RetryRules(throttledRequest("3600")); delay != time.Minute {
+		t.Errorf("delay %s, want Retry-After capped at MaxThrottleDelay", delay)
+	}
+	if delay := r.RetryRules(throttledRequest("")); delay > time.Minute {
+		t.Errorf("delay %s without Retry-After, want the backoff up to MaxThrottleDelay", delay)
+	}
+
+	unbounded := retryAfterRetryer{}
+	if delay := unbounded.RetryRules(throttledRequest("86400")); delay != client.DefaultRetryerMaxThrottleDelay {
+		t.Errorf("delay %s, want the default MaxThrottleDelay %s", delay, client.DefaultRetryerMaxThrottleDelay)
+	}
+}
+
+func TestParseRetryAfter(t *testing.T) {
+	now := time.Date(2020, 1, 2, 3, 4, 5, 0, time.UTC)
+	cases := []struct {
+		value string
+		delay time.Duration
+		ok    bool
+	}{
+		{"", 0, false},
+		{"120", 2 * time.Minute, true},
+		{"-1", 0, false},
+		{now.Add(30 * time.Second).Format(http.TimeFormat), 30 * time.Second, true},
+		{now.Add(-time.Minute).Format(http.TimeFormat), 0, true},
+		{"soon", 0, false},
+	}
+	for _, c := range cases {
+		delay, ok := parseRetryAfter(c.value, now)
+		if delay != c.delay || ok != c.ok {
+			t.Errorf("parseRetryAfter(%q) = %s, %v, want %s, %v", c.value, delay, ok, c.delay, c.ok)
+		}
+	}
+}
+
+func TestPrepareAppliesRetryDelays(t *testing.T) {
+	p := &DynamoDBPlugin{
+		TableName:       testTable,
+		Region:          "us-east-1",
+		AccessKeyID:     "AKID",
+		SecretAccessKey: "SECRET",
+		RetryBaseDelay:  200 * time.Millisecond,
+		RetryMaxDelay:   20 * time.Second,
+	}
+	if err := p.prepare(); err != nil {
+		t.Fatalf("prepare: %s", err)
+	}
+	r, ok := p.CloudWatch.(*cloudwatch.CloudWatch).Retryer.(retryAfterRetryer)
+	if !ok {
+		t.Fatalf("retryer %T, want retryAfterRetryer", p.CloudWatch.(*cloudwatch.CloudWatch).Retryer)
+	}
+	if r.MinRetryDelay != 200*time.Millisecond || r.MinThrottleDelay != 200*time.Millisecond {
+		t.Errorf("base delays %s and %s, want 200ms", r.MinRetryDelay, r.MinThrottleDelay)
+	}
+	if r.MaxRetryDelay != 20*time.Second || r.MaxThrottleDelay != 20*time.Second {
+		t.Errorf("max delays %s and %s, want 20s", r.MaxRetryDelay, r.MaxThrottleDelay)
+	}
+	if r.NumMaxRetries != client.DefaultRetryerMaxNumRetries {
+		t.Errorf("%d retries, want the default %d", r.NumMaxRetries, client.DefaultRetryerMaxNumRetries)
+	}
+}
@@ -0,0 +1,233 @@
+package mpawsdynamodb
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// describeTable returns the description of the table, calling DescribeTable only once per plugin
+func (p *DynamoDBPlugin) describeTable(ctx aws.Context) (*dynamodb.TableDescription, error) {
+	if p.tableDescription != nil {
+		return p.tableDescription, nil
+	}
+	if p.DynamoDB == nil {
+		return nil, errors.New("no DynamoDB client to describe the table")
+	}
+	res, err := p.DynamoDB.DescribeTableWithContext(ctx, &dynamodb.DescribeTableInput{
+		TableName: aws.String(p.TableName),
+	})
+	if err != nil {
+		return nil, err
+	}
+	if res.Table == nil {
+		return nil, errors.New("DescribeTable returned no table")
+	}
+	p.tableDescription = res.Table
+	return p.tableDescription, nil
+}
+
+// payPerRequest tells whether the table is in the on-demand capacity mode
+func (p *DynamoDBPlugin) payPerRequest(ctx aws.Context) (bool, error) {
+	table, err := p.describeTable(ctx)
+	if err != nil {
+		return false, err
+	}
+	// tables which have been provisioned since before on-demand existed have no summary
+	if table.BillingModeSummary == nil {
+		return false, nil
+	}
+	return aws.StringValue(table.BillingModeSummary.BillingMode) == dynamodb.BillingModePayPerRequest, nil
+}
+
+// correctTableNameCase replaces TableName with the name of the existing table differing only in case, if CloudWatch has no metrics
+// for TableName, since CloudWatch dimensions are case-sensitive and a wrong case silently yields no data
+func (p *DynamoDBPlugin) correctTableNameCase(ctx aws.Context) error {
+	res, err := p.CloudWatch.ListMetricsWithContext(ctx, &cloudwatch.ListMetricsInput{
+		Dimensions: []*cloudwatch.DimensionFilter{{
+			Name:  aws.String("TableName"),
+			Value: aws.String(p.TableName),
+		}},
+		Namespace: aws.String(namespace),
+	})
+	if err != nil {
+		return err
+	}
+	if len(res.Metrics) > 0 {
+		return nil
+	}
+	if p.DynamoDB == nil {
+		return errors.New("no DynamoDB client to list the tables")
+	}
+
+	var found string
+	err = p.DynamoDB.ListTablesPagesWithContext(ctx, &dynamodb.ListTablesInput{}, func(page *dynamodb.ListTablesOutput, lastPage bool) bool {
+		for _, name := range page.TableNames {
+			if strings.EqualFold(aws.StringValue(name), p.TableName) {
+				found = aws.StringValue(name)
+				return false
+			}
+		}
+		return true
+	})
+	if err != nil {
+		return err
+	}
+	if found != "" && found != p.TableName {
+		log.Printf("No metrics for the table %s, using %s instead", p.TableName, found)
+		p.TableName = found
+		p.tableDescription = nil
+	}
+	return nil
+}
+
+// metrics per replica of a global table, collected with GlobalTable. "#" in MackerelName is replaced with the replica region
+var (
+	// queried in the region of the table with the replica region as ReceivingRegion, along with replicationMetricsGroup
+	pendingReplicationMetricsGroup = []MetricsGroup{
+		{CloudWatchName: "PendingReplicationCount", Metrics: []Metric{
+			{MackerelName: "PendingReplicationCount.#", Type: metricsTypeSum},
+		}},
+	}
+	// queried in the replica region
+	replicaCapacityMetricsGroup = []MetricsGroup{
+		{CloudWatchName: "ConsumedReadCapacityUnits", Metrics: []Metric{
+			{MackerelName: "ReplicaReadCapacity.#.ConsumedSum", Type: metricsTypeSum},
+		}},
+		{CloudWatchName: "ConsumedWriteCapacityUnits", Metrics: []Metric{
+			{MackerelName: "ReplicaWriteCapacity.#.ConsumedSum", Type: metricsTypeSum},
+		}},
+	}
+)
+
+// fetchGlobalTableMetrics collects the replication and consumed capacity metrics of every replica of the table listed by DescribeTable.
+// The consumed capacity is queried in the region of each replica. Every call is recorded with the run, and only giving up the run is returned
+func (p *DynamoDBPlugin) fetchGlobalTableMetrics(run *fetchRun, stats map[string]interface{}) error {
+	table, err := p.describeTable(run.ctx)
+	if err := run.record("DescribeTable", err); err != nil {
+		return err
+	}
+	if err != nil {
+		return nil
+	}
+	// arn:aws:dynamodb:<region>:<account>:table/<name>
+	var tableRegion string
+	if parts := strings.Split(aws.StringValue(table.TableArn), ":"); len(parts) > 3 {
+		tableRegion = parts[3]
+	}
+
+	replicationGroups := pendingReplicationMetricsGroup
+	if !p.Replication {
+		// otherwise ReplicationLatency of every receiving region is collected by the Replication groups already
+		replicationGroups = append(append([]MetricsGroup(nil), replicationMetricsGroup...), pendingReplicationMetricsGroup...)
+	}
+	for _, replica := range table.Replicas {
+		region := aws.StringValue(replica.RegionName)
+		if region == "" || region == tableRegion {
+			continue
+		}
+		dimensions := append(p.tableDimensions(), &cloudwatch.Dimension{
+			Name:  aws.String("ReceivingRegion"),
+			Value: aws.String(region),
+		})
+		for _, met := range replicationGroups {
+			if err := p.fetchReplicaMetrics(run, p.CloudWatch, met, dimensions, region, stats); err != nil {
+				return err
+			}
+		}
+
+		cw, err := p.replicaCloudWatch(region)
+		if err := run.record("CloudWatch client of "+region, err); err != nil {
+			return err
+		}
+		if err != nil {
+			continue
+		}
+		for _, met := range replicaCapacityMetricsGroup {
+			if err := p.fetchReplicaMetrics(run, cw, met, p.tableDimensions(), region, stats); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// replicaCloudWatch returns the CloudWatch client for the region of a replica, created once per region with the rate limiter of the plugin
+func (p *DynamoDBPlugin) replicaCloudWatch(region string) (cloudwatchiface.CloudWatchAPI, error) {
+	if cw, ok := p.regionalClients[region]; ok {
+		return cw, nil
+	}
+	if p.regionalCloudWatch == nil {
+		// e.g. in -replay
+		return nil, errors.New("no CloudWatch client for the region")
+	}
+	cw, err := p.regionalCloudWatch(region)
+	if err != nil {
+		return nil, err
+	}
+	if p.regionalClients == nil {
+		p.regionalClients = make(map[string]cloudwatchiface.CloudWatchAPI)
+	}
+	p.regionalClients[region] = p.limitRate(cw)
+	return p.regionalClients[region], nil
+}
+
+// fetchReplicaMetrics fetches a metrics group of the replica in region with cw, and appends its latest values to stats.
+// It returns an error only when the run gives up
+func (p *DynamoDBPlugin) fetchReplicaMetrics(run *fetchRun, cw cloudwatchiface.CloudWatchAPI, mg MetricsGroup, dimensions []*cloudwatch.Dimension, region string, stats map[string]interface{}) error {
+	name := mg.CloudWatchName + " of " + region
+	if run.skip(name) {
+		return nil
+	}
+	dps, err := p.getLastPoints(run.ctx, cw, mg, dimensions)
+	if err := run.record(name, err); err != nil {
+		return err
+	}
+	if err != nil {
+		return nil
+	}
+	for _, met := range mg.Metrics {
+		label := strings.Replace(met.MackerelName, "#", sanitizeMetricKeyPart(region), 1)
+		dp := p.selectDatapoint(dps, met.Type)
+		if dp == nil {
+			p.emptyMetrics++
+		}
+		transformAndAppendDatapoint(dp, met.Type, label, stats)
+		p.recordTimestamp(label, dp)
+		p.recordPeriod(label, mg, dp)
+	}
+	return nil
+}
+
+// indexARN is the parsed ARN of a global secondary index
+type indexARN struct {
+	Region    string
+	TableName string
+	IndexName string
+}
+
+// parseIndexARN parses the ARN of a global secondary index, arn:<partition>:dynamodb:<region>:<account>:table/<table>/index/<index>
+func parseIndexARN(arn string) (*indexARN, error) {
+	parts := strings.SplitN(arn, ":", 6)
+	if len(parts) != 6 || parts[0] != "arn" || parts[2] != "dynamodb" {
+		return nil, fmt.Errorf("not an ARN of DynamoDB: %s", arn)
+	}
+	resource := strings.Split(parts[5], "/")
+	if len(resource) < 2 || resource[0] != "table" || resource[1] == "" {
+		return nil, fmt.Errorf("no table in the ARN: %s", arn)
+	}
+	if len(resource) != 4 || resource[2] != "index" || resource[3] == "" {
+		return nil, fmt.Errorf("no index in the ARN, expected table/<table>/index/<index>: %s", arn)
+	}
+	return &indexARN{
+		Region:    parts[3],
+		TableName: resource[1],
+		IndexName: resource[3],
+	}, nil
+}
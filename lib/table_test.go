@@ -0,0 +1,106 @@
+package mpawsdynamodb
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/dynamodb"
+)
+
+// newGlobalTablePlugin returns a plugin with GlobalTable for a table in us-east-1 with a replica in us-west-2,
+// whose replication metrics are in cw
+func newGlobalTablePlugin(cw cloudwatchiface.CloudWatchAPI) *DynamoDBPlugin {
+	p := newTestPlugin(cw)
+	p.GlobalTable = true
+	p.DynamoDB = &fakeDynamoDB{table: &dynamodb.TableDescription{
+		TableName: aws.String(testTable),
+		TableArn:  aws.String("arn:aws:dynamodb:us-east-1:123456789012:table/" + testTable),
+		Replicas: []*dynamodb.ReplicaDescription{
+			{RegionName: aws.String("us-east-1")},
+			{RegionName: aws.String("us-west-2")},
+		},
+	}}
+	return p
+}
+
+func TestFetchGlobalTableMetrics(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ReplicationLatency", "ReceivingRegion", "us-west-2", datapoint(2*time.Minute, 40))
+	cw.add("PendingReplicationCount", "ReceivingRegion", "us-west-2", datapoint(2*time.Minute, 3))
+	replica := newFakeCloudWatch()
+	replica.add("ConsumedReadCapacityUnits", "", "", datapoint(2*time.Minute, 120))
+	replica.add("ConsumedWriteCapacityUnits", "", "", datapoint(2*time.Minute, 60))
+
+	p := newGlobalTablePlugin(cw)
+	var created []string
+	p.regionalCloudWatch = func(region string) (cloudwatchiface.CloudWatchAPI, error) {
+		created = append(created, region)
+		return replica, nil
+	}
+	for i := 0; i < 2; i++ {
+		stats, err := p.FetchMetrics()
+		if err != nil {
+			t.Fatalf("FetchMetrics: %s", err)
+		}
+		for key, want := range map[string]float64{
+			"ReplicationLatency.us-west-2.Average":    40,
+			"PendingReplicationCount.us-west-2":       3,
+			"ReplicaReadCapacity.us-west-2.Consumed":  2,
+			"ReplicaWriteCapacity.us-west-2.Consumed": 1,
+		} {
+			if stats[key] != want {
+				t.Errorf("%s = %v, want %v", key, stats[key], want)
+			}
+		}
+		for key := range stats {
+			if strings.Contains(key, "us-east-1") {
+				t.Errorf("%s is reported for the region of the table itself", key)
+			}
+		}
+	}
+	if !reflect.DeepEqual(created, []string{"us-west-2"}) {
+		t.Errorf("CloudWatch clients created for %v, want one for us-west-2", created)
+	}
+	if n := cw.count("ReplicationLatency"); n != 2 {
+		t.Errorf("ReplicationLatency queried %d times in 2 runs", n)
+	}
+
+	// along with Replication, which collects ReplicationLatency per receiving region too
+	p.Replication = true
+	if _, err := p.FetchMetrics(); err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if n := cw.count("ReplicationLatency"); n != 3 {
+		t.Errorf("ReplicationLatency queried %d times in a run with Replication, want once", n-2)
+	}
+}
+
+func TestFetchGlobalTableMetricsWithoutRegionalClient(t *testing.T) {
+	cw := newFakeCloudWatch()
+	cw.add("ReplicationLatency", "ReceivingRegion", "us-west-2", datapoint(2*time.Minute, 40))
+	p := newGlobalTablePlugin(cw)
+
+	var logs bytes.Buffer
+	log.SetOutput(&logs)
+	defer log.SetOutput(os.Stderr)
+	stats, err := p.FetchMetrics()
+	if err != nil {
+		t.Fatalf("FetchMetrics: %s", err)
+	}
+	if stats["ReplicationLatency.us-west-2.Average"] != 40.0 {
+		t.Errorf("ReplicationLatency.us-west-2.Average = %v, want 40", stats["ReplicationLatency.us-west-2.Average"])
+	}
+	if _, ok := stats["ReplicaReadCapacity.us-west-2.Consumed"]; ok {
+		t.Error("ReplicaReadCapacity is reported without a client for the region")
+	}
+	if !strings.Contains(logs.String(), "CloudWatch client of us-west-2: ") {
+		t.Errorf("no warning about the missing client:\n%s", logs.String())
+	}
+}